@@ -1,5 +1,3 @@
 module gosh
 
 go 1.18
-
-require github.com/mitchellh/go-ps v1.0.0
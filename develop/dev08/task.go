@@ -2,17 +2,27 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
-
-	gops "github.com/mitchellh/go-ps"
+	"time"
+	"unsafe"
 )
 
 /*
@@ -26,25 +36,102 @@ import (
 
 Реализовать утилиту netcat (nc) клиент
 принимать данные из stdin и отправлять в соединение (tcp/udp)
+
+nc реализована как встроенная команда оболочки (см. функцию nc).
 Программа должна проходить все тесты. Код должен проходить проверки go vet и golint.
 */
 
 var (
 	// ErrExit возвращается командой exit.
 	ErrExit = errors.New("exit")
+	// ErrNoSuchJob возвращается, если задание с указанным номером не найдено.
+	ErrNoSuchJob = errors.New("no such job")
+	// ErrMissingArgument возвращается командой, вызванной без обязательного аргумента.
+	ErrMissingArgument = errors.New("missing argument")
+	// ErrIncomplete возвращается разборщиком, если ввод закончился посреди конструкции
+	// (незакрытая кавычка, if без fi и т.п.). В интерактивном режиме нужно дочитать строку.
+	ErrIncomplete = errors.New("unexpected end of file")
+	// ErrInterrupted прерывает выполнение командной строки, если активное задание
+	// было завершено по Ctrl+C: иначе бесконечный цикл было бы не остановить.
+	ErrInterrupted = errors.New("interrupted")
 )
 
+// loopControl возвращается командами break и continue и прерывает n вложенных циклов.
+type loopControl struct {
+	n    int
+	cont bool
+}
+
+func (e *loopControl) Error() string {
+	if e.cont {
+		return "continue: only meaningful in a loop"
+	}
+	return "break: only meaningful in a loop"
+}
+
+// returnControl возвращается командой return и завершает выполнение функции.
+type returnControl struct {
+	status int
+}
+
+func (e *returnControl) Error() string {
+	return "return: can only return from a function"
+}
+
+// statusError возвращается встроенной командой, которая должна завершиться
+// с определённым кодом, не выводя сообщения об ошибке.
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.status)
+}
+
+// exitWith возвращает ошибку, после которой встроенная команда завершится с кодом status.
+func exitWith(status int) error {
+	if status == 0 {
+		return nil
+	}
+	return &statusError{status}
+}
+
+// isControlFlow сообщает, является ли ошибка сигналом об изменении порядка
+// выполнения (exit, break, continue, return, Ctrl+C), а не ошибкой команды.
+func isControlFlow(err error) bool {
+	var (
+		lc *loopControl
+		rc *returnControl
+	)
+	return errors.Is(err, ErrExit) || errors.Is(err, ErrInterrupted) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &lc) || errors.As(err, &rc)
+}
+
 // ErrIncorrectCommand возвращается при невозможности выполнить команду.
 func ErrIncorrectCommand(cmd string) error {
 	return fmt.Errorf("Bad command or file name: %s", cmd)
 }
 
+// коды завершения, которые оболочка назначает сама
+const (
+	statusFailure  = 1
+	statusSyntax   = 2
+	statusNotFound = 127
+	// к номеру сигнала, завершившего процесс, прибавляется statusSignal
+	statusSignal = 128
+)
+
 type (
 	// контекст выполнения команды
 	cmdContext struct {
+		sh     *shell
 		stdin  io.Reader
 		stdOut io.Writer
-		args   string
+		stdErr io.Writer
+		args   []string
+		// исходные файлы ввода-вывода - для команд, которые сами запускают команды
+		std stdio
 	}
 
 	// функция команды
@@ -59,153 +146,5308 @@ var cmdMap = map[string]cmdFunc{
 	"echo": echo,
 	"ps":   ps,
 	"kill": kill,
+	"jobs": jobs,
+	"fg":   fg,
+	"bg":   bg,
+	"wait": wait,
+	"trap": trap,
+	"nc":   nc,
+
+	"export":  export,
+	"unset":   unset,
+	"set":     set,
+	"alias":   alias,
+	"unalias": unalias,
+	"history": history,
+
+	"break":    breakLoop,
+	"continue": continueLoop,
+	"return":   returnFunc,
+}
+
+// Команды, которые сами выполняют команды оболочки или обращаются к диспетчеру,
+// добавляются в него при инициализации: иначе возник бы цикл в инициализации cmdMap.
+func init() {
+	cmdMap["type"] = typeCmd
+	cmdMap["which"] = which
+	cmdMap["env"] = env
+	cmdMap["source"] = source
+	cmdMap["."] = source
+}
+
+// Синтаксическое дерево командной строки. Слова хранятся в исходном виде,
+// вместе с кавычками: раскрываются они непосредственно перед выполнением.
+type (
+	// command - элемент конвейера: простая команда, подоболочка, группа,
+	// управляющая конструкция или определение функции.
+	command interface{}
+
+	// simpleCmd - простая команда: присваивания NAME=value, имя и аргументы.
+	simpleCmd struct {
+		assigns []string
+		words   []string
+	}
+
+	// subshell - список команд в круглых скобках. Выполняется в копии оболочки,
+	// поэтому, например, cd внутри не меняет каталог самой оболочки.
+	subshell struct {
+		body *cmdList
+	}
+
+	// braceGroup - список команд в фигурных скобках, выполняемый в текущей оболочке.
+	braceGroup struct {
+		body *cmdList
+	}
+
+	// ifCmd - if cond; then body; [elif cond; then body;]... [else elseBody;] fi
+	ifCmd struct {
+		conds    []*cmdList
+		bodies   []*cmdList
+		elseBody *cmdList
+	}
+
+	// forCmd - for name [in items]; do body; done. Без "in" перебираются позиционные параметры.
+	forCmd struct {
+		name  string
+		items []string
+		hasIn bool
+		body  *cmdList
+	}
+
+	// whileCmd - while cond; do body; done. При until == true цикл идёт, пока cond неуспешен.
+	whileCmd struct {
+		cond, body *cmdList
+		until      bool
+	}
+
+	// funcDef - определение функции: name() body или function name body.
+	funcDef struct {
+		name string
+		body command
+	}
+
+	// pipeline - команды, соединённые "|". Если negate == true, код завершения инвертируется ("!").
+	pipeline struct {
+		cmds   []command
+		negate bool
+		text   string
+	}
+
+	// andOrList - конвейеры, соединённые "&&" и "||". ops[i] стоит между pipes[i] и pipes[i+1].
+	andOrList struct {
+		pipes      []*pipeline
+		ops        []string
+		background bool
+		text       string
+	}
+
+	// cmdList - последовательность and-or списков, разделённых ";", "&" или переводом строки.
+	cmdList struct {
+		items []*andOrList
+	}
+)
+
+// stdio - стандартные потоки, с которыми выполняется команда.
+type stdio struct {
+	in, out, err *os.File
+}
+
+// jobState - состояние задания.
+type jobState int
+
+const (
+	jobRunning jobState = iota
+	jobStopped
+	jobDone
+)
+
+func (s jobState) String() string {
+	switch s {
+	case jobRunning:
+		return "Running"
+	case jobStopped:
+		return "Stopped"
+	default:
+		return "Done"
+	}
+}
+
+// process - внешний процесс, входящий в задание.
+type process struct {
+	pid int
+	// группа процессов задания (0, если процесс остался в группе оболочки)
+	pgid    int
+	cmd     *exec.Cmd
+	status  syscall.WaitStatus
+	done    bool
+	stopped bool
+	// ошибка wait4, если дождаться процесса не удалось
+	err error
+	// множество запущенных процессов, из которого процесс удаляется по завершении
+	running *runningSet
 }
 
-// cmdLine представляет командную строку, введенную пользователем.
-type cmdLine struct {
-	// команда
-	cmd string
-	// аргументы
-	args string
-	// следующая команда в пайпе
-	nextCmd *cmdLine
+// job - задание: конвейер, запущенный оболочкой на переднем или заднем плане.
+// Все внешние процессы задания находятся в одной группе процессов pgid.
+type job struct {
+	id   int
+	pgid int
+	// командная строка, как её ввёл пользователь
+	text  string
+	procs []*process
+	// последний процесс конвейера; nil, если конвейер заканчивается встроенной командой
+	last *process
+	// код завершения последней команды, если она выполнялась внутри оболочки
+	status int
+	// закрывается, когда завершились все встроенные команды конвейера
+	builtins chan struct{}
+	state    jobState
+	// состояние, о котором пользователю уже сообщено
+	reported jobState
 }
 
-// Execute запускает команду.
-func (cl cmdLine) Execute(stdIn io.Reader, stdOut io.Writer) error {
-	buf := bytes.Buffer{}
-	ctx := cmdContext{
-		stdin:  stdIn,
-		stdOut: stdOut,
-		args:   cl.args,
+// shell хранит состояние оболочки, в том числе таблицу заданий.
+type shell struct {
+	// текущий каталог оболочки; процесс gosh свой каталог не меняет,
+	// чтобы подоболочки могли иметь собственный
+	dir string
+	// переменные оболочки, функции и псевдонимы; в окружение внешних программ
+	// попадают только экспортированные переменные
+	vars     map[string]string
+	exported map[string]bool
+	funcs    map[string]command
+	aliases  map[string]string
+	// псевдонимы, которые сейчас раскрываются: повторно они не раскрываются
+	aliasing map[string]bool
+	// $0 и позиционные параметры $1..$N
+	name string
+	args []string
+	// код завершения последней выполненной команды
+	status int
+	jobs   []*job
+	// управление заданиями включено, только если stdin - терминал
+	jobControl bool
+	ttyFd      int
+	// редактор строки интерактивной оболочки, хранит историю команд
+	editor *lineEditor
+	// встроенные команды, добавленные через Interpreter.Register
+	builtins map[string]cmdFunc
+	// контекст выполнения: при его отмене выполнение прекращается
+	ctx context.Context
+	// запущенные процессы оболочки и всех её копий
+	running *runningSet
+	// ownGroups - помещать задания в собственные группы процессов и без управления заданиями
+	ownGroups bool
+	// группа процессов самой оболочки и группа, которая владела терминалом до запуска
+	pgid     int
+	origPgid int
+	// interactive - оболочка читает команды пользователя, а не сценарий
+	interactive bool
+	// сигналы, перехваченные оболочкой (nil, если оболочка их не перехватывает),
+	// и обработчики trap; ключ 0 - обработчик выхода EXIT
+	signals *sigState
+	traps   map[syscall.Signal]string
+	// toplevel - это сама оболочка, а не её копия: сигналы обрабатывает только она
+	toplevel bool
+	// выполняется обработчик trap - повторно сигналы не обрабатываются
+	inTrap bool
+	// об остановленных заданиях при попытке выхода уже предупредили
+	stoppedWarned bool
+}
+
+// newShell создаёт оболочку. Переменные оболочки заполняются из окружения процесса.
+// Если оболочка интерактивная и стандартный ввод - терминал, она переходит
+// в собственную группу процессов и захватывает терминал.
+func newShell(interactive bool) *shell {
+	sh := &shell{
+		ttyFd:    int(os.Stdin.Fd()),
+		vars:     make(map[string]string),
+		exported: make(map[string]bool),
+		funcs:    make(map[string]command),
+		aliases:  make(map[string]string),
+		aliasing: make(map[string]bool),
+		builtins: make(map[string]cmdFunc),
+		traps:    make(map[syscall.Signal]string),
+		ctx:      context.Background(),
+		running:  newRunningSet(),
+		name:     "gosh",
+		toplevel: true,
 	}
-	// если в пайпе есть команда дальше - буферизируем стандартный вывод
-	if cl.nextCmd != nil {
-		ctx.stdOut = &buf
+	sh.dir, _ = os.Getwd()
+	sh.importEnv(os.Environ())
+	sh.vars["PWD"] = sh.dir
+	sh.exported["PWD"] = true
+	sh.interactive = interactive
+	if !interactive || !isTerminal(sh.ttyFd) {
+		return sh
 	}
-	runCommand, ok := cmdMap[cl.cmd]
-	if ok {
-		err := runCommand(ctx)
+	// если нас запустили в фоне - ждём, пока не выведут на передний план
+	for {
+		fgPgid, err := tcgetpgrp(sh.ttyFd)
 		if err != nil {
-			return err
+			return sh
 		}
-	} else {
-		// Если команда отсутствует в стандартном наборе,
-		// пытаемся запустить ее в настоящем shell.
-		cmd := exec.Command(cl.cmd, strings.Split(cl.args, " ")...)
-		if cl.args == "" {
-			cmd.Args = nil
+		if fgPgid == syscall.Getpgrp() {
+			sh.origPgid = fgPgid
+			break
 		}
-		cmd.Stdin = ctx.stdin
-		cmd.Stdout = ctx.stdOut
-		err := cmd.Run()
+		syscall.Kill(-syscall.Getpgrp(), syscall.SIGTTIN)
+	}
+	// SIGINT, SIGQUIT и SIGTSTP с терминала предназначены активному заданию, а не оболочке.
+	// Перехватываем их вместо signal.Ignore: игнорирование наследуется дочерними процессами.
+	sh.catchSignals()
+	// становимся лидером собственной группы (для лидера сессии вызов завершится ошибкой,
+	// но он и так лидер своей группы)
+	syscall.Setpgid(0, 0)
+	sh.pgid = syscall.Getpgrp()
+	if err := tcsetpgrp(sh.ttyFd, sh.pgid); err != nil {
+		return sh
+	}
+	sh.jobControl = true
+	return sh
+}
+
+// importEnv добавляет переменные окружения NAME=value в экспортированные переменные оболочки.
+func (sh *shell) importEnv(env []string) {
+	for _, kv := range env {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			sh.vars[name] = value
+			sh.exported[name] = true
+		}
+	}
+}
+
+// close возвращает терминал группе процессов, владевшей им до запуска оболочки.
+func (sh *shell) close() {
+	if sh.jobControl {
+		tcsetpgrp(sh.ttyFd, sh.origPgid)
+	}
+}
+
+// subshell создаёт копию оболочки. Изменения, сделанные в копии, не затрагивают
+// родительскую оболочку; задания родителя в копии не видны.
+func (sh *shell) subshell(jobControl bool) *shell {
+	sub := &shell{
+		dir:        sh.dir,
+		vars:       make(map[string]string, len(sh.vars)),
+		exported:   make(map[string]bool, len(sh.exported)),
+		funcs:      make(map[string]command, len(sh.funcs)),
+		aliases:    make(map[string]string, len(sh.aliases)),
+		aliasing:   make(map[string]bool, len(sh.aliasing)),
+		builtins:   sh.builtins,
+		ctx:        sh.ctx,
+		running:    sh.running,
+		ownGroups:  sh.ownGroups,
+		signals:    sh.signals,
+		traps:      make(map[syscall.Signal]string),
+		name:       sh.name,
+		args:       append([]string(nil), sh.args...),
+		status:     sh.status,
+		jobControl: sh.jobControl && jobControl,
+		ttyFd:      sh.ttyFd,
+		pgid:       sh.pgid,
+	}
+	for k, v := range sh.vars {
+		sub.vars[k] = v
+	}
+	for k, v := range sh.exported {
+		sub.exported[k] = v
+	}
+	for k, v := range sh.funcs {
+		sub.funcs[k] = v
+	}
+	for k, v := range sh.aliases {
+		sub.aliases[k] = v
+	}
+	for k, v := range sh.aliasing {
+		sub.aliasing[k] = v
+	}
+	// как и в sh, обработчики в копии сбрасываются, а игнорирование сигналов сохраняется
+	for sig, action := range sh.traps {
+		if action == "" {
+			sub.traps[sig] = action
+		}
+	}
+	return sub
+}
+
+// runList выполняет список команд и возвращает код завершения последней из них.
+// Ошибка возвращается, только если выполнение нужно прервать (например, exit).
+func (sh *shell) runList(l *cmdList, std stdio) (int, error) {
+	status := 0
+	for _, ao := range l.items {
+		if err := sh.ctx.Err(); err != nil {
+			return status, err
+		}
+		if err := sh.handleSignals(std); err != nil {
+			return sh.status, err
+		}
+		var err error
+		if ao.background {
+			status, err = sh.runBackground(ao, std)
+		} else {
+			status, err = sh.runAndOr(ao, std)
+		}
+		sh.status = status
 		if err != nil {
-			return err
+			return status, err
 		}
 	}
-	// если в пайпе есть команда, запускаем её
-	// стандартный ввод берём из буфера
-	if cl.nextCmd != nil {
-		return cl.nextCmd.Execute(&buf, stdOut)
+	return status, nil
+}
+
+// runAndOr выполняет конвейеры and-or списка: после "&&" следующий конвейер
+// запускается, только если предыдущий завершился успешно, после "||" - только при неудаче.
+func (sh *shell) runAndOr(ao *andOrList, std stdio) (int, error) {
+	status, err := sh.runPipeline(ao.pipes[0], std, false)
+	for i, op := range ao.ops {
+		if err != nil {
+			break
+		}
+		if (op == "&&") != (status == 0) {
+			continue
+		}
+		sh.status = status
+		status, err = sh.runPipeline(ao.pipes[i+1], std, false)
 	}
-	return nil
+	return status, err
+}
+
+// runBackground запускает and-or список в фоне. Одиночный конвейер становится
+// обычным заданием, а список из нескольких выполняется в копии оболочки.
+func (sh *shell) runBackground(ao *andOrList, std stdio) (int, error) {
+	if len(ao.pipes) == 1 {
+		return sh.runPipeline(ao.pipes[0], std, true)
+	}
+	j := &job{text: ao.text, builtins: make(chan struct{})}
+	sub := sh.subshell(false)
+	go func() {
+		j.status, _ = sub.runAndOr(ao, std)
+		close(j.builtins)
+	}()
+	sh.addJob(j)
+	sh.announceJob(j, std)
+	return 0, nil
 }
 
-// parseCmdLine переводит строку, введенную пользователем в структуру команды
-func parseCmdLine(c string) *cmdLine {
-	c = strings.TrimSpace(c)
-	pipe := strings.Split(c, "|")
-	var nextCmd *cmdLine = nil
-	if len(pipe) > 1 {
-		c = pipe[0]
-		nextCmd = parseCmdLine(strings.Join(pipe[1:], "|"))
+// runPipeline выполняет конвейер. Одиночная встроенная команда или группа на
+// переднем плане выполняется прямо в оболочке, остальное - как новое задание.
+func (sh *shell) runPipeline(p *pipeline, std stdio, background bool) (int, error) {
+	if len(p.cmds) == 1 && !background {
+		status, err := sh.runCommand(p.cmds[0], std)
+		return p.exitStatus(status), err
 	}
-	fields := strings.Fields(c)
-	cl := cmdLine{
-		cmd:     fields[0],
-		nextCmd: nextCmd,
+	j := &job{text: p.text, builtins: make(chan struct{})}
+	var wg sync.WaitGroup
+	in := std.in
+	for i, c := range p.cmds {
+		// каналы, созданные для этой команды: оболочка закрывает свои копии после запуска
+		var pipes []*os.File
+		if i > 0 {
+			pipes = append(pipes, in)
+		}
+		// если в пайпе есть команда дальше - соединяем их каналом
+		out := std.out
+		var next *os.File
+		if i < len(p.cmds)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				closeFiles(pipes)
+				fmt.Fprintln(std.err, err)
+				break
+			}
+			out, next = w, r
+			pipes = append(pipes, w)
+		}
+		last := i == len(p.cmds)-1
+		cmdStd := stdio{in: in, out: out, err: std.err}
+		var args, assigns []string
+		if sc, ok := c.(*simpleCmd); ok && !sh.isAlias(sc) {
+			args, assigns = sh.expandSimple(sc)
+		}
+		if len(args) > 0 && !sh.isInternal(args[0]) {
+			// Если команда отсутствует в стандартном наборе,
+			// пытаемся запустить её как внешнюю программу.
+			proc, err := sh.startProcess(args, assigns, j, cmdStd, background)
+			closeFiles(pipes)
+			if err != nil {
+				fmt.Fprintln(std.err, err)
+				if last {
+					j.status = statusNotFound
+				}
+			} else {
+				j.procs = append(j.procs, proc)
+				if last {
+					j.last = proc
+				}
+			}
+		} else {
+			// встроенные команды, функции и составные команды конвейера
+			// выполняются в отдельных горутинах, каждая в своей копии оболочки
+			wg.Add(1)
+			sub := sh.subshell(false)
+			go func(c command, args, assigns []string, std stdio, pipes []*os.File, last bool) {
+				defer wg.Done()
+				var status int
+				if args != nil || assigns != nil {
+					status, _ = sub.runSimple(args, assigns, std)
+				} else {
+					status, _ = sub.runCommand(c, std)
+				}
+				closeFiles(pipes)
+				if last {
+					j.status = status
+				}
+			}(c, args, assigns, cmdStd, pipes, last)
+		}
+		in = next
 	}
-	if len(fields) > 1 {
-		cl.args = strings.Join(fields[1:], " ")
+	go func() {
+		wg.Wait()
+		close(j.builtins)
+	}()
+	sh.addJob(j)
+	if background {
+		sh.announceJob(j, std)
+		return 0, nil
 	}
-	return &cl
+	status, err := sh.waitForeground(j, std)
+	return p.exitStatus(status), err
 }
 
-// printPrompt выводит приглашение командной строки.
-func printPrompt() {
-	dir, _ := os.Getwd()
-	fmt.Printf("%s$ ", dir)
+// exitStatus применяет к коду завершения конвейера отрицание "!".
+func (p *pipeline) exitStatus(status int) int {
+	if !p.negate {
+		return status
+	}
+	if status == 0 {
+		return statusFailure
+	}
+	return 0
 }
 
-// выводит строку на экран
-func echo(c cmdContext) error {
-	fmt.Fprintln(c.stdOut, c.args)
-	return nil
+// isInternal сообщает, выполняет ли команду name сама оболочка: это функция или встроенная команда.
+func (sh *shell) isInternal(name string) bool {
+	if _, ok := sh.funcs[name]; ok {
+		return true
+	}
+	_, ok := sh.builtin(name)
+	return ok
 }
 
-// ps выводит список процессов
-func ps(c cmdContext) error {
-	processes, err := gops.Processes()
+// builtin ищет встроенную команду: сначала среди добавленных через Interpreter.Register, затем в cmdMap.
+func (sh *shell) builtin(name string) (cmdFunc, bool) {
+	if f, ok := sh.builtins[name]; ok {
+		return f, true
+	}
+	f, ok := cmdMap[name]
+	return f, ok
+}
+
+// runCommand выполняет команду в текущей оболочке и дожидается её завершения.
+func (sh *shell) runCommand(c command, std stdio) (int, error) {
+	switch c := c.(type) {
+	case *simpleCmd:
+		if sh.isAlias(c) {
+			return sh.runAlias(c, std)
+		}
+		args, assigns := sh.expandSimple(c)
+		return sh.runSimple(args, assigns, std)
+	case *braceGroup:
+		return sh.runList(c.body, std)
+	case *subshell:
+		status, err := sh.subshell(true).runList(c.body, std)
+		// exit в подоболочке завершает только её
+		if errors.Is(err, ErrExit) {
+			err = nil
+		}
+		return status, err
+	case *ifCmd:
+		for i, cond := range c.conds {
+			status, err := sh.runList(cond, std)
+			if err != nil {
+				return status, err
+			}
+			if status == 0 {
+				return sh.runList(c.bodies[i], std)
+			}
+		}
+		if c.elseBody != nil {
+			return sh.runList(c.elseBody, std)
+		}
+		return 0, nil
+	case *forCmd:
+		items := sh.args
+		if c.hasIn {
+			items = sh.expandWords(c.items)
+		}
+		status := 0
+		for _, item := range items {
+			sh.vars[c.name] = item
+			var err error
+			status, err = sh.runList(c.body, std)
+			if stop, err := loopExit(err); stop {
+				return status, err
+			}
+		}
+		return status, nil
+	case *whileCmd:
+		status := 0
+		for {
+			condStatus, err := sh.runList(c.cond, std)
+			if err != nil {
+				return condStatus, err
+			}
+			if (condStatus == 0) == c.until {
+				return status, nil
+			}
+			status, err = sh.runList(c.body, std)
+			if stop, err := loopExit(err); stop {
+				return status, err
+			}
+		}
+	case *funcDef:
+		sh.funcs[c.name] = c.body
+		return 0, nil
+	}
+	return 0, nil
+}
+
+// isAlias сообщает, начинается ли команда с псевдонима, который нужно раскрыть.
+// Псевдонимом может быть только имя команды, записанное без кавычек.
+func (sh *shell) isAlias(c *simpleCmd) bool {
+	if len(c.words) == 0 || strings.ContainsAny(c.words[0], `'"\$`) || sh.aliasing[c.words[0]] {
+		return false
+	}
+	_, ok := sh.aliases[c.words[0]]
+	return ok
+}
+
+// runAlias подставляет вместо имени команды текст псевдонима и выполняет получившуюся строку.
+func (sh *shell) runAlias(c *simpleCmd, std stdio) (int, error) {
+	name := c.words[0]
+	words := append(append(append([]string(nil), c.assigns...), sh.aliases[name]), c.words[1:]...)
+	l, err := parseCmdLine(strings.Join(words, " "))
 	if err != nil {
-		return err
+		fmt.Fprintf(std.err, "%s: %v\n", name, err)
+		return statusSyntax, nil
+	}
+	sh.aliasing[name] = true
+	defer delete(sh.aliasing, name)
+	return sh.runList(l, std)
+}
+
+// loopExit разбирает ошибку, которой завершилось тело цикла. stop == true означает,
+// что цикл нужно прекратить; ошибку err нужно передать внешним конструкциям.
+func loopExit(err error) (stop bool, _ error) {
+	var lc *loopControl
+	if !errors.As(err, &lc) {
+		return err != nil, err
 	}
-	fmt.Fprintln(c.stdOut, "PID\t\tname")
-	fmt.Fprintln(c.stdOut, "------------------------")
-	for _, p := range processes {
-		fmt.Fprintf(c.stdOut, "%d\t\t%s\n", p.Pid(), p.Executable())
+	if lc.n > 1 {
+		// break/continue относится к одному из внешних циклов
+		lc.n--
+		return true, lc
 	}
-	return nil
+	return !lc.cont, nil
 }
 
-// pwd выводит текущий путь
-func pwd(c cmdContext) error {
-	dir, err := os.Getwd()
+// runSimple выполняет простую команду с уже раскрытыми аргументами. Команда без
+// аргументов только присваивает переменные; для функций и встроенных команд
+// присваивания действуют на время их выполнения, внешним программам передаются в окружении.
+func (sh *shell) runSimple(args, assigns []string, std stdio) (int, error) {
+	if len(args) == 0 {
+		for _, a := range assigns {
+			name, value, _ := strings.Cut(a, "=")
+			sh.vars[name] = value
+		}
+		return 0, nil
+	}
+	if body, ok := sh.funcs[args[0]]; ok {
+		return sh.withVars(assigns, func() (int, error) {
+			return sh.callFunction(body, args, std)
+		})
+	}
+	if runCommand, ok := sh.builtin(args[0]); ok {
+		return sh.withVars(assigns, func() (int, error) {
+			return sh.runBuiltin(runCommand, args, std)
+		})
+	}
+	j := &job{text: strings.Join(args, " "), builtins: make(chan struct{})}
+	close(j.builtins)
+	proc, err := sh.startProcess(args, assigns, j, std, false)
+	if isControlFlow(err) {
+		return statusFailure, err
+	}
+	if err != nil {
+		fmt.Fprintln(std.err, err)
+		return statusNotFound, nil
+	}
+	j.procs = []*process{proc}
+	j.last = proc
+	sh.addJob(j)
+	return sh.waitForeground(j, std)
+}
+
+// withVars устанавливает переменные на время выполнения f, затем восстанавливает прежние значения.
+func (sh *shell) withVars(assigns []string, f func() (int, error)) (int, error) {
+	saved := make(map[string]*string)
+	for _, a := range assigns {
+		name, value, _ := strings.Cut(a, "=")
+		if _, ok := saved[name]; !ok {
+			if old, ok := sh.vars[name]; ok {
+				saved[name] = &old
+			} else {
+				saved[name] = nil
+			}
+		}
+		sh.vars[name] = value
+	}
+	defer func() {
+		for name, old := range saved {
+			if old == nil {
+				delete(sh.vars, name)
+			} else {
+				sh.vars[name] = *old
+			}
+		}
+	}()
+	return f()
+}
+
+// callFunction вызывает функцию: на время вызова позиционными параметрами
+// становятся её аргументы.
+func (sh *shell) callFunction(body command, args []string, std stdio) (int, error) {
+	saved := sh.args
+	sh.args = args[1:]
+	defer func() { sh.args = saved }()
+	status, err := sh.runCommand(body, std)
+	var rc *returnControl
+	if errors.As(err, &rc) {
+		return rc.status, nil
+	}
+	return status, err
+}
+
+// runBuiltin выполняет встроенную команду. Ошибка команды выводится в stderr
+// и превращается в код завершения 1.
+func (sh *shell) runBuiltin(runCommand cmdFunc, args []string, std stdio) (int, error) {
+	err := runCommand(cmdContext{
+		sh:     sh,
+		stdin:  std.in,
+		stdOut: std.out,
+		stdErr: std.err,
+		args:   args[1:],
+		std:    std,
+	})
+	if isControlFlow(err) {
+		return sh.status, err
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status, nil
+	}
+	if err != nil {
+		fmt.Fprintf(std.err, "%s: %v\n", args[0], err)
+		return statusFailure, nil
+	}
+	return 0, nil
+}
+
+// closeFiles закрывает переданные файлы.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// lookPath ищет исполняемый файл. Пути, содержащие "/", отсчитываются от
+// текущего каталога оболочки, остальные имена ищутся в каталогах переменной PATH оболочки.
+func (sh *shell) lookPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(sh.dir, name)
+		}
+		return name, checkExecutable(name)
+	}
+	for _, dir := range filepath.SplitList(sh.vars["PATH"]) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(sh.dir, dir)
+		}
+		p := filepath.Join(dir, name)
+		if checkExecutable(p) == nil {
+			return p, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// checkExecutable проверяет, что path - исполняемый файл.
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintln(c.stdOut, dir)
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return os.ErrPermission
+	}
 	return nil
 }
 
-// kill убивает процесс с данным pid.
-func kill(c cmdContext) error {
-	pid, err := strconv.Atoi(c.args)
+// environ возвращает окружение внешней программы: экспортированные переменные
+// оболочки и дополнительные переменные extra в виде NAME=value.
+func (sh *shell) environ(extra []string) []string {
+	env := make([]string, 0, len(sh.exported)+len(extra))
+	for _, name := range sortedKeys(sh.vars) {
+		if sh.exported[name] {
+			env = append(env, name+"="+sh.vars[name])
+		}
+	}
+	return append(env, extra...)
+}
+
+// startProcess запускает внешнюю программу в группе процессов задания.
+// env - дополнительные переменные окружения в виде NAME=value.
+func (sh *shell) startProcess(args, env []string, j *job, std stdio, background bool) (*process, error) {
+	path, err := sh.lookPath(args[0])
 	if err != nil {
-		return err
+		return nil, ErrIncorrectCommand(args[0])
+	}
+	newCmd := func(path string, args []string) *exec.Cmd {
+		cmd := &exec.Cmd{
+			Path:   path,
+			Args:   args,
+			Dir:    sh.dir,
+			Stdin:  std.in,
+			Stdout: std.out,
+			Stderr: std.err,
+			Env:    sh.environ(env),
+		}
+		if sh.jobControl || sh.ownGroups {
+			// первый процесс конвейера становится лидером группы; если задание
+			// запускается на переднем плане, он же забирает себе терминал
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Setpgid:    true,
+				Pgid:       j.pgid,
+				Foreground: sh.jobControl && j.pgid == 0 && !background,
+				Ctty:       sh.ttyFd,
+			}
+		}
+		return cmd
+	}
+	if err := sh.ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := newCmd(path, args)
+	err = cmd.Start()
+	if errors.Is(err, syscall.ENOEXEC) {
+		// исполняемый файл без строки #! считаем сценарием gosh
+		if self, selfErr := os.Executable(); selfErr == nil {
+			cmd = newCmd(self, append([]string{"gosh", path}, args[1:]...))
+			err = cmd.Start()
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
-	return syscall.Kill(pid, syscall.SIGINT)
+	if j.pgid == 0 && (sh.jobControl || sh.ownGroups) {
+		j.pgid = cmd.Process.Pid
+	}
+	p := &process{pid: cmd.Process.Pid, pgid: j.pgid, cmd: cmd, running: sh.running}
+	sh.running.add(p)
+	return p, nil
 }
 
-func cd(c cmdContext) error {
-	return os.Chdir(c.args)
+// addJob регистрирует задание в таблице и присваивает ему номер.
+func (sh *shell) addJob(j *job) {
+	j.id = 1
+	if len(sh.jobs) > 0 {
+		j.id = sh.jobs[len(sh.jobs)-1].id + 1
+	}
+	sh.jobs = append(sh.jobs, j)
 }
 
-// exit завершает работу оболочки.
-func exit(cmdContext) error {
-	return ErrExit
+// announceJob сообщает номер только что запущенного фонового задания.
+func (sh *shell) announceJob(j *job, std stdio) {
+	if !sh.jobControl {
+		return
+	}
+	pid := j.pgid
+	if pid == 0 && len(j.procs) > 0 {
+		pid = j.procs[len(j.procs)-1].pid
+	}
+	if pid == 0 {
+		// задание выполняется целиком внутри оболочки
+		fmt.Fprintf(std.err, "[%d]\n", j.id)
+		return
+	}
+	fmt.Fprintf(std.err, "[%d] %d\n", j.id, pid)
 }
 
-// parser обрабатывает строку, введенную пользователем.
-func parser(c string) error {
-	if c == "" || c == "\n" {
-		return nil
+// removeJob удаляет задание из таблицы.
+func (sh *shell) removeJob(j *job) {
+	for i := range sh.jobs {
+		if sh.jobs[i] == j {
+			sh.jobs = append(sh.jobs[:i], sh.jobs[i+1:]...)
+			return
+		}
 	}
-	cl := parseCmdLine(c)
-	return cl.Execute(os.Stdin, os.Stdout)
 }
 
-func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Println("Welcome to gosh!")
-	printPrompt()
-	for scanner.Scan() {
-		if err := parser(scanner.Text()); err != nil {
-			if errors.Is(err, ErrExit) {
+// waitBuiltins ожидает фоновые задания, которые выполняются в горутинах самой оболочки
+// (встроенные команды, функции, составные команды). В отличие от внешних программ
+// они не переживут выход из оболочки, и их вывод был бы потерян. Ожидание прерывается
+// так же, как встроенные команды (см. interruptContext).
+func (sh *shell) waitBuiltins() {
+	ctx, cancel := sh.interruptContext()
+	defer cancel()
+	for _, j := range sh.jobs {
+		select {
+		case <-j.builtins:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitForeground ожидает завершения или остановки задания на переднем плане,
+// после чего возвращает терминал оболочке. Возвращает код завершения задания и
+// ErrInterrupted, если в интерактивном режиме задание было прервано по Ctrl+C.
+func (sh *shell) waitForeground(j *job, std stdio) (int, error) {
+	defer func() {
+		if sh.jobControl {
+			tcsetpgrp(sh.ttyFd, sh.pgid)
+		}
+	}()
+	j.state = jobRunning
+	if sh.signals != nil {
+		sh.signals.setForeground(j, true)
+		defer sh.signals.setForeground(j, false)
+	}
+	j.wait(syscall.WUNTRACED)
+	if j.state == jobStopped {
+		j.reported = jobStopped
+		fmt.Fprintf(std.out, "\n%s\n", sh.formatJob(j))
+		return statusSignal + int(syscall.SIGTSTP), nil
+	}
+	sh.removeJob(j)
+	if err := sh.ctx.Err(); err != nil {
+		// задание убито при отмене контекста - сообщать о сигнале не нужно
+		return j.exitStatus(), err
+	}
+	if err := j.waitErr(); err != nil {
+		fmt.Fprintln(std.err, err)
+	}
+	if j.last != nil && j.last.status.Signaled() {
+		switch sig := j.last.status.Signal(); sig {
+		case syscall.SIGINT:
+			fmt.Fprintln(std.out)
+			if sh.jobControl && sh.traps[sig] != "" {
+				// Ctrl+C получило задание, а не оболочка, но обработчик trap должен сработать
+				sh.signals.raise(sig)
+			} else if sh.jobControl {
+				return j.exitStatus(), ErrInterrupted
+			}
+		case syscall.SIGPIPE:
+		default:
+			fmt.Fprintln(std.err, sig)
+		}
+	}
+	return j.exitStatus(), nil
+}
+
+// wait блокируется, пока все процессы задания не завершатся
+// или (при флаге WUNTRACED) пока задание не будет остановлено.
+func (j *job) wait(options int) {
+	for _, p := range j.procs {
+		for !p.done && !p.stopped {
+			var ws syscall.WaitStatus
+			_, err := syscall.Wait4(p.pid, &ws, options, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				p.lost(err)
 				break
 			}
-			fmt.Fprintln(os.Stderr, err)
+			p.setStatus(ws)
+		}
+		if p.stopped {
+			j.update()
+			return
+		}
+	}
+	<-j.builtins
+	j.state = jobDone
+}
+
+// update опрашивает процессы задания без блокировки и обновляет его состояние.
+func (j *job) update() {
+	for _, p := range j.procs {
+		for !p.done {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(p.pid, &ws, syscall.WNOHANG|syscall.WUNTRACED|syscall.WCONTINUED, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				p.lost(err)
+			} else if pid == p.pid {
+				p.setStatus(ws)
+			}
+			break
+		}
+	}
+	j.state = jobDone
+	for _, p := range j.procs {
+		if p.stopped {
+			j.state = jobStopped
+			return
+		}
+		if !p.done {
+			j.state = jobRunning
+		}
+	}
+	if j.state == jobDone {
+		select {
+		case <-j.builtins:
+		default:
+			j.state = jobRunning
+		}
+	}
+}
+
+// exitStatus возвращает код завершения задания - код последней команды конвейера.
+// Для процесса, убитого сигналом, это 128 + номер сигнала.
+func (j *job) exitStatus() int {
+	if j.last == nil {
+		return j.status
+	}
+	ws := j.last.status
+	if ws.Signaled() {
+		return statusSignal + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// setStatus обновляет состояние процесса по результату wait4.
+func (p *process) setStatus(ws syscall.WaitStatus) {
+	switch {
+	case ws.Stopped():
+		p.stopped = true
+	case ws.Continued():
+		p.stopped = false
+	default:
+		p.status = ws
+		p.done = true
+		p.stopped = false
+		p.running.remove(p)
+		p.cmd.Process.Release()
+	}
+}
+
+// lost отмечает процесс, который не удалось дождаться. ECHILD означает, что процесс
+// уже ожидан кем-то другим; его код завершения неизвестен, как и при других ошибках
+// wait4, поэтому процесс считается завершившимся неудачно - с кодом 127, как у wait
+// для чужого процесса, - а ошибка сохраняется, чтобы о ней сообщить.
+func (p *process) lost(err error) {
+	if err == syscall.ECHILD {
+		p.err = fmt.Errorf("pid %d was reaped elsewhere, exit status unknown", p.pid)
+	} else {
+		p.err = fmt.Errorf("wait for pid %d: %v", p.pid, err)
+	}
+	p.setStatus(syscall.WaitStatus(statusNotFound << 8))
+}
+
+// waitErr возвращает ошибку ожидания первого процесса задания, которого не удалось дождаться.
+func (j *job) waitErr() error {
+	for _, p := range j.procs {
+		if p.err != nil {
+			return p.err
+		}
+	}
+	return nil
+}
+
+// signal посылает сигнал всем процессам задания.
+func (j *job) signal(sig syscall.Signal) error {
+	if j.pgid != 0 {
+		return syscall.Kill(-j.pgid, sig)
+	}
+	for _, p := range j.procs {
+		if !p.done {
+			if err := syscall.Kill(p.pid, sig); err != nil {
+				return err
+			}
 		}
-		printPrompt()
 	}
+	return nil
+}
+
+// reportJobs обновляет состояние фоновых заданий и удаляет завершившиеся.
+// В интерактивном режиме сообщает о заданиях, которые завершились или были
+// остановлены с момента последней проверки.
+func (sh *shell) reportJobs(w io.Writer) {
+	for _, j := range append([]*job(nil), sh.jobs...) {
+		j.update()
+		if sh.jobControl && (j.state == jobDone || j.state != j.reported) {
+			fmt.Fprintln(w, sh.formatJob(j))
+		}
+		j.reported = j.state
+		if j.state == jobDone {
+			sh.removeJob(j)
+		}
+	}
+}
+
+// formatJob возвращает строку с описанием задания в формате команды jobs.
+func (sh *shell) formatJob(j *job) string {
+	return fmt.Sprintf("[%d]%s  %-8s\t\t%s", j.id, sh.jobMark(j), j.state, j.text)
+}
+
+// jobMark возвращает "+" для текущего задания, "-" для предыдущего и пробел для остальных.
+func (sh *shell) jobMark(j *job) string {
+	n := len(sh.jobs)
+	switch {
+	case n > 0 && sh.jobs[n-1] == j:
+		return "+"
+	case n > 1 && sh.jobs[n-2] == j:
+		return "-"
+	}
+	return " "
+}
+
+// findJob ищет задание по спецификации: %n, %%, %+, %-, %строка или просто n.
+// Пустая спецификация означает текущее задание.
+func (sh *shell) findJob(spec string) (*job, error) {
+	n := len(sh.jobs)
+	spec = strings.TrimPrefix(spec, "%")
+	switch spec {
+	case "", "%", "+":
+		if n > 0 {
+			return sh.jobs[n-1], nil
+		}
+		return nil, ErrNoSuchJob
+	case "-":
+		if n > 1 {
+			return sh.jobs[n-2], nil
+		}
+		return nil, ErrNoSuchJob
+	}
+	if id, err := strconv.Atoi(spec); err == nil {
+		for _, j := range sh.jobs {
+			if j.id == id {
+				return j, nil
+			}
+		}
+		return nil, fmt.Errorf("%%%s: %w", spec, ErrNoSuchJob)
+	}
+	for i := n - 1; i >= 0; i-- {
+		if strings.HasPrefix(sh.jobs[i].text, spec) {
+			return sh.jobs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%%%s: %w", spec, ErrNoSuchJob)
+}
+
+// sigState - сигналы, полученные оболочкой. Go доставляет их в канал ch, а
+// горутина dispatch сразу пересылает сигналы завершения заданию переднего плана
+// и ставит их в очередь. Обработчики trap и действия по умолчанию выполняет
+// основной поток оболочки в безопасных точках (см. handleSignals).
+// Состояние общее для оболочки и всех её копий.
+type sigState struct {
+	ch          chan os.Signal
+	interactive bool
+
+	mu sync.Mutex
+	// сигналы, ещё не обработанные оболочкой
+	pending []syscall.Signal
+	// закрывается и заменяется новым при получении сигнала, прерывающего ожидание
+	// во встроенных командах; last - этот сигнал
+	arrived chan struct{}
+	last    syscall.Signal
+	// сигналы, для которых задан trap: true - обработчик, false - сигнал игнорируется
+	traps map[syscall.Signal]bool
+	// задания переднего плана и их процессы
+	foreground map[*job][]int
+	// закрывается при первом SIGHUP без обработчика trap, чтобы прервать чтение
+	// команды: иначе до безопасной точки дело не дойдёт, пока пользователь не нажмёт Enter
+	hup chan struct{}
+}
+
+// caughtSignals возвращает сигналы, которые оболочка перехватывает всегда.
+func caughtSignals(interactive bool) []os.Signal {
+	sigs := []os.Signal{syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGCHLD}
+	if interactive {
+		sigs = append(sigs, syscall.SIGTSTP)
+	}
+	return sigs
+}
+
+// newSigState создаёт состояние сигналов; перехват включает catchSignals.
+func newSigState(interactive bool) *sigState {
+	return &sigState{
+		ch:          make(chan os.Signal, 16),
+		interactive: interactive,
+		arrived:     make(chan struct{}),
+		hup:         make(chan struct{}),
+		traps:       make(map[syscall.Signal]bool),
+		foreground:  make(map[*job][]int),
+	}
+}
+
+// catchSignals включает перехват сигналов. Interpreter сигналы не перехватывает:
+// они принадлежат встраивающей его программе.
+func (sh *shell) catchSignals() {
+	if sh.signals != nil {
+		return
+	}
+	s := newSigState(sh.interactive)
+	signal.Notify(s.ch, caughtSignals(sh.interactive)...)
+	sh.signals = s
+	go s.dispatch()
+}
+
+// dispatch принимает сигналы, пока процесс не завершится.
+func (s *sigState) dispatch() {
+	for v := range s.ch {
+		sig := v.(syscall.Signal)
+		s.mu.Lock()
+		s.forward(sig)
+		s.pending = append(s.pending, sig)
+		handler, trapped := s.traps[sig]
+		if handler || !trapped && s.interrupts(sig) {
+			s.last = sig
+			close(s.arrived)
+			s.arrived = make(chan struct{})
+		}
+		if sig == syscall.SIGHUP && !trapped {
+			select {
+			case <-s.hup:
+			default:
+				close(s.hup)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// interrupts сообщает, прерывает ли сигнал без обработчика выполняемые команды:
+// SIGINT и SIGHUP - всегда, SIGQUIT и SIGTERM - только в неинтерактивной оболочке.
+func (s *sigState) interrupts(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGHUP:
+		return true
+	case syscall.SIGQUIT, syscall.SIGTERM:
+		return !s.interactive
+	}
+	return false
+}
+
+// forward пересылает сигнал завершения заданиям переднего плана. Задания в группе
+// оболочки SIGINT и SIGQUIT с терминала уже получили сами, повторно они им не посылаются.
+func (s *sigState) forward(sig syscall.Signal) {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP:
+	default:
+		return
+	}
+	for j, pids := range s.foreground {
+		if j.pgid != 0 {
+			syscall.Kill(-j.pgid, sig)
+			continue
+		}
+		if sig == syscall.SIGINT || sig == syscall.SIGQUIT {
+			continue
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, sig)
+		}
+	}
+}
+
+// setForeground отмечает начало (on) или конец ожидания задания на переднем плане.
+func (s *sigState) setForeground(j *job, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !on {
+		delete(s.foreground, j)
+		return
+	}
+	pids := make([]int, 0, len(j.procs))
+	for _, p := range j.procs {
+		pids = append(pids, p.pid)
+	}
+	s.foreground[j] = pids
+}
+
+// setTrap изменяет действие при получении сигнала: "-" - действие по умолчанию,
+// пустая строка - игнорирование, иначе - обработчик.
+func (s *sigState) setTrap(sig syscall.Signal, action string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	caught := false
+	for _, c := range caughtSignals(s.interactive) {
+		caught = caught || c == sig
+	}
+	switch {
+	case action == "-":
+		delete(s.traps, sig)
+		if !caught {
+			signal.Reset(sig)
+		}
+	case action == "" && !caught:
+		// игнорирование, как и в sh, наследуют запущенные программы
+		s.traps[sig] = false
+		signal.Ignore(sig)
+	default:
+		s.traps[sig] = action != ""
+		signal.Notify(s.ch, sig)
+	}
+}
+
+// raise ставит сигнал в очередь, как если бы его получила оболочка.
+func (s *sigState) raise(sig syscall.Signal) {
+	s.mu.Lock()
+	s.pending = append(s.pending, sig)
+	s.mu.Unlock()
+}
+
+// take возвращает и очищает очередь полученных сигналов.
+func (s *sigState) take() []syscall.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sigs := s.pending
+	s.pending = nil
+	return sigs
+}
+
+// wait возвращает канал, закрывающийся при получении очередного сигнала,
+// который прерывает ожидание.
+func (s *sigState) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.arrived
+}
+
+// hangup возвращает канал, закрывающийся при получении SIGHUP без обработчика.
+func (s *sigState) hangup() <-chan struct{} {
+	return s.hup
+}
+
+// lastSignal возвращает последний сигнал, прервавший ожидание.
+func (s *sigState) lastSignal() syscall.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// handleSignals обрабатывает сигналы, полученные с момента прошлого вызова: выполняет
+// обработчики trap и действия по умолчанию. Вызывается между командами и перед
+// приглашением, поэтому обработчики выполняются в основном потоке оболочки.
+// Возвращает ErrExit, если сигнал завершает оболочку, и ErrInterrupted, если он
+// прерывает выполняемую строку интерактивной оболочки.
+func (sh *shell) handleSignals(std stdio) error {
+	if sh.signals == nil || !sh.toplevel || sh.inTrap {
+		return nil
+	}
+	var interrupted error
+	for _, sig := range sh.signals.take() {
+		if sig == syscall.SIGCHLD {
+			sh.reapJobs()
+		}
+		if action, ok := sh.traps[sig]; ok {
+			if action == "" {
+				continue
+			}
+			if err := sh.runTrap(action, std); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case sig == syscall.SIGINT && sh.interactive:
+			sh.status = statusSignal + int(sig)
+			interrupted = ErrInterrupted
+		case sh.signals.interrupts(sig):
+			sh.status = statusSignal + int(sig)
+			return ErrExit
+		}
+	}
+	return interrupted
+}
+
+// runTrap выполняет команды обработчика trap. Код завершения $? после обработчика
+// восстанавливается, если только в нём не была выполнена команда exit.
+func (sh *shell) runTrap(action string, std stdio) error {
+	l, err := parseCmdLine(action)
+	if err != nil {
+		fmt.Fprintf(std.err, "trap: %v\n", err)
+		return nil
+	}
+	status := sh.status
+	sh.inTrap = true
+	_, err = sh.runList(l, std)
+	sh.inTrap = false
+	if errors.Is(err, ErrExit) {
+		return err
+	}
+	sh.status = status
+	return nil
+}
+
+// runExitTrap выполняет обработчик EXIT при выходе из оболочки (не более одного раза).
+func (sh *shell) runExitTrap(std stdio) {
+	action := sh.traps[0]
+	delete(sh.traps, 0)
+	if action != "" {
+		sh.runTrap(action, std)
+	}
+}
+
+// reapJobs опрашивает фоновые задания, чтобы завершившиеся процессы не оставались
+// зомби. Сообщает о них пользователю reportJobs.
+func (sh *shell) reapJobs() {
+	for _, j := range sh.jobs {
+		if j.state != jobDone {
+			j.update()
+		}
+	}
+}
+
+// hasStoppedJobs сообщает, есть ли остановленные задания.
+func (sh *shell) hasStoppedJobs() bool {
+	for _, j := range sh.jobs {
+		j.update()
+		if j.state == jobStopped {
+			return true
+		}
+	}
+	return false
+}
+
+// hangupJobs посылает SIGHUP незавершённым заданиям при выходе из интерактивной
+// оболочки, а остановленным - ещё и SIGCONT, чтобы они смогли его обработать.
+func (sh *shell) hangupJobs() {
+	for _, j := range sh.jobs {
+		j.update()
+		if j.state == jobDone {
+			continue
+		}
+		j.signal(syscall.SIGHUP)
+		if j.state == jobStopped {
+			j.signal(syscall.SIGCONT)
+		}
+	}
+}
+
+// tokenKind - вид лексемы командной строки.
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokOp
+	tokNewline
+	tokEOF
+)
+
+// token - лексема: слово (в исходном виде, с кавычками) или оператор.
+// pos и end - границы лексемы в исходной строке.
+type token struct {
+	kind     tokenKind
+	val      string
+	pos, end int
+}
+
+// операторы, распознаваемые лексером; длинные идут раньше своих префиксов
+var operators = []string{"&&", "||", "|", "&", ";", "(", ")"}
+
+// lex разбивает командную строку на лексемы.
+func lex(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			// экранированный перевод строки - продолжение команды
+			if i+2 == len(s) {
+				return nil, fmt.Errorf("syntax error: %w", ErrIncomplete)
+			}
+			i += 2
+			continue
+		case c == '#':
+			// комментарий до конца строки
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '\n':
+			toks = append(toks, token{kind: tokNewline, val: "\n", pos: i, end: i + 1})
+			i++
+			continue
+		}
+		if op := matchOperator(s[i:]); op != "" {
+			toks = append(toks, token{kind: tokOp, val: op, pos: i, end: i + len(op)})
+			i += len(op)
+			continue
+		}
+		end, err := scanWord(s, i)
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, token{kind: tokWord, val: s[i:end], pos: i, end: end})
+		i = end
+	}
+	return append(toks, token{kind: tokEOF, pos: len(s), end: len(s)}), nil
+}
+
+// matchOperator возвращает оператор, с которого начинается строка, или "".
+func matchOperator(s string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// scanWord находит конец слова, начинающегося с позиции start, с учётом кавычек
+// и экранирования.
+func scanWord(s string, start int) (int, error) {
+	i := start
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(s) {
+				return 0, fmt.Errorf("syntax error: %w", ErrIncomplete)
+			}
+			i += 2
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return 0, fmt.Errorf("%w while looking for matching `''", ErrIncomplete)
+			}
+			i += end + 2
+		case c == '"':
+			i++
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(s) {
+				return 0, fmt.Errorf("%w while looking for matching `\"'", ErrIncomplete)
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || matchOperator(s[i:]) != "":
+			return i, nil
+		default:
+			i++
+		}
+	}
+	return i, nil
+}
+
+// cmdParser - синтаксический анализатор командной строки (рекурсивный спуск).
+type cmdParser struct {
+	src  string
+	toks []token
+	pos  int
+}
+
+// peek возвращает текущую лексему, не продвигаясь дальше.
+func (p *cmdParser) peek() token {
+	return p.toks[p.pos]
+}
+
+// next возвращает текущую лексему и переходит к следующей.
+func (p *cmdParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isOp сообщает, является ли текущая лексема оператором op.
+func (p *cmdParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.val == op
+}
+
+// isWord сообщает, является ли текущая лексема словом w (используется для "{" и "}").
+func (p *cmdParser) isWord(w string) bool {
+	t := p.peek()
+	return t.kind == tokWord && t.val == w
+}
+
+// expectWord проверяет, что текущая лексема - слово w, и пропускает её.
+func (p *cmdParser) expectWord(w string) error {
+	if !p.isWord(w) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+// skipNewlines пропускает переводы строк.
+func (p *cmdParser) skipNewlines() {
+	for p.peek().kind == tokNewline {
+		p.next()
+	}
+}
+
+// textFrom возвращает исходный текст от позиции start до конца последней прочитанной лексемы.
+func (p *cmdParser) textFrom(start int) string {
+	return p.src[start:p.toks[p.pos-1].end]
+}
+
+// unexpected возвращает синтаксическую ошибку для текущей лексемы.
+func (p *cmdParser) unexpected() error {
+	t := p.peek()
+	switch t.kind {
+	case tokEOF:
+		return fmt.Errorf("syntax error: %w", ErrIncomplete)
+	case tokNewline:
+		return errors.New("syntax error near unexpected token `newline'")
+	}
+	return fmt.Errorf("syntax error near unexpected token `%s'", t.val)
+}
+
+// ключевые слова, которые в начале команды завершают текущий список
+var listTerminators = map[string]bool{
+	"}": true, "then": true, "elif": true, "else": true, "fi": true, "do": true, "done": true,
+}
+
+// parseList разбирает список and-or списков до конца ввода, ")" или
+// завершающего ключевого слова (}, then, fi, done...).
+func (p *cmdParser) parseList() (*cmdList, error) {
+	l := &cmdList{}
+	for {
+		p.skipNewlines()
+		t := p.peek()
+		if t.kind == tokEOF || p.isOp(")") || (t.kind == tokWord && listTerminators[t.val]) {
+			return l, nil
+		}
+		ao, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		l.items = append(l.items, ao)
+		switch {
+		case p.isOp(";"), p.peek().kind == tokNewline:
+			p.next()
+		case p.isOp("&"):
+			p.next()
+			ao.background = true
+		default:
+			return l, nil
+		}
+	}
+}
+
+// parseAndOr разбирает конвейеры, соединённые "&&" и "||".
+func (p *cmdParser) parseAndOr() (*andOrList, error) {
+	start := p.peek().pos
+	ao := &andOrList{}
+	for {
+		pl, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		ao.pipes = append(ao.pipes, pl)
+		if !p.isOp("&&") && !p.isOp("||") {
+			break
+		}
+		ao.ops = append(ao.ops, p.next().val)
+		p.skipNewlines()
+	}
+	ao.text = p.textFrom(start)
+	return ao, nil
+}
+
+// parsePipeline разбирает конвейер: [!] команда [| команда]...
+func (p *cmdParser) parsePipeline() (*pipeline, error) {
+	start := p.peek().pos
+	pl := &pipeline{}
+	if p.isWord("!") {
+		p.next()
+		pl.negate = true
+	}
+	for {
+		c, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pl.cmds = append(pl.cmds, c)
+		if !p.isOp("|") {
+			break
+		}
+		p.next()
+		p.skipNewlines()
+	}
+	pl.text = p.textFrom(start)
+	return pl, nil
+}
+
+// parseCommand разбирает одну команду конвейера: ( список ), { список; },
+// управляющую конструкцию, определение функции или простую команду.
+func (p *cmdParser) parseCommand() (command, error) {
+	switch {
+	case p.isWord("if"):
+		return p.parseIf()
+	case p.isWord("for"):
+		return p.parseFor()
+	case p.isWord("while"), p.isWord("until"):
+		return p.parseWhile()
+	case p.isWord("function"):
+		p.next()
+		name := p.peek()
+		if name.kind != tokWord || !isName(name.val) {
+			return nil, p.unexpected()
+		}
+		p.next()
+		if p.isOp("(") {
+			p.next()
+			if !p.isOp(")") {
+				return nil, p.unexpected()
+			}
+			p.next()
+		}
+		return p.parseFuncBody(name.val)
+	case p.isFuncDef():
+		name := p.next().val
+		p.next()
+		p.next()
+		return p.parseFuncBody(name)
+	case p.isOp("("):
+		p.next()
+		body, err := p.parseBody()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return &subshell{body: body}, nil
+	case p.isWord("{"):
+		p.next()
+		body, err := p.parseBody()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isWord("}") {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return &braceGroup{body: body}, nil
+	}
+	sc := &simpleCmd{}
+	for p.peek().kind == tokWord {
+		w := p.next().val
+		if len(sc.words) == 0 && isAssignment(w) {
+			sc.assigns = append(sc.assigns, w)
+			continue
+		}
+		sc.words = append(sc.words, w)
+	}
+	if len(sc.words) == 0 && len(sc.assigns) == 0 {
+		return nil, p.unexpected()
+	}
+	return sc, nil
+}
+
+// parseIf разбирает конструкцию if ... then ... [elif ... then ...] [else ...] fi.
+func (p *cmdParser) parseIf() (command, error) {
+	c := &ifCmd{}
+	p.next()
+	for {
+		cond, err := p.parseBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectWord("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.parseBody()
+		if err != nil {
+			return nil, err
+		}
+		c.conds = append(c.conds, cond)
+		c.bodies = append(c.bodies, body)
+		if !p.isWord("elif") {
+			break
+		}
+		p.next()
+	}
+	if p.isWord("else") {
+		p.next()
+		body, err := p.parseBody()
+		if err != nil {
+			return nil, err
+		}
+		c.elseBody = body
+	}
+	return c, p.expectWord("fi")
+}
+
+// parseFor разбирает цикл for name [in слова...]; do ...; done.
+func (p *cmdParser) parseFor() (command, error) {
+	p.next()
+	name := p.peek()
+	if name.kind != tokWord || !isName(name.val) {
+		return nil, p.unexpected()
+	}
+	p.next()
+	c := &forCmd{name: name.val}
+	p.skipNewlines()
+	if p.isWord("in") {
+		p.next()
+		c.hasIn = true
+		for p.peek().kind == tokWord {
+			c.items = append(c.items, p.next().val)
+		}
+		if !p.isOp(";") && p.peek().kind != tokNewline {
+			return nil, p.unexpected()
+		}
+		p.next()
+	} else if p.isOp(";") {
+		p.next()
+	}
+	p.skipNewlines()
+	body, err := p.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+	c.body = body
+	return c, nil
+}
+
+// parseWhile разбирает циклы while/until cond; do ...; done.
+func (p *cmdParser) parseWhile() (command, error) {
+	c := &whileCmd{until: p.next().val == "until"}
+	cond, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+	c.cond, c.body = cond, body
+	return c, nil
+}
+
+// parseDoGroup разбирает тело цикла: do список; done.
+func (p *cmdParser) parseDoGroup() (*cmdList, error) {
+	if err := p.expectWord("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return body, p.expectWord("done")
+}
+
+// isFuncDef сообщает, начинается ли с текущей лексемы определение функции name().
+func (p *cmdParser) isFuncDef() bool {
+	if p.pos+2 >= len(p.toks) {
+		return false
+	}
+	name, open, closing := p.toks[p.pos], p.toks[p.pos+1], p.toks[p.pos+2]
+	return name.kind == tokWord && isName(name.val) &&
+		open.kind == tokOp && open.val == "(" && closing.kind == tokOp && closing.val == ")"
+}
+
+// parseFuncBody разбирает тело функции - составную команду.
+func (p *cmdParser) parseFuncBody(name string) (command, error) {
+	p.skipNewlines()
+	if p.peek().kind == tokWord && !p.isWord("{") && !p.isWord("if") &&
+		!p.isWord("for") && !p.isWord("while") && !p.isWord("until") {
+		return nil, p.unexpected()
+	}
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	return &funcDef{name: name, body: body}, nil
+}
+
+// isName сообщает, является ли строка допустимым именем переменной или функции.
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// isAssignment сообщает, является ли слово присваиванием NAME=value.
+func isAssignment(w string) bool {
+	name, _, ok := strings.Cut(w, "=")
+	return ok && isName(name)
+}
+
+// parseBody разбирает непустой список команд внутри скобок.
+func (p *cmdParser) parseBody() (*cmdList, error) {
+	body, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(body.items) == 0 {
+		return nil, p.unexpected()
+	}
+	return body, nil
+}
+
+// parseCmdLine переводит строку, введенную пользователем, в синтаксическое дерево.
+func parseCmdLine(c string) (*cmdList, error) {
+	toks, err := lex(c)
+	if err != nil {
+		return nil, err
+	}
+	p := &cmdParser{src: c, toks: toks}
+	l, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return l, nil
+}
+
+// expandSimple раскрывает слова простой команды в аргументы, а правые части
+// присваиваний - в значения. Присваивания возвращаются в виде NAME=value.
+func (sh *shell) expandSimple(sc *simpleCmd) (args, assigns []string) {
+	for _, a := range sc.assigns {
+		name, value, _ := strings.Cut(a, "=")
+		assigns = append(assigns, name+"="+sh.expandString(value))
+	}
+	return sh.expandWords(sc.words), assigns
+}
+
+// expandWords раскрывает слова команды в список аргументов: сначала фигурные
+// скобки, затем параметры, разбиение на поля и шаблоны имён файлов.
+func (sh *shell) expandWords(words []string) []string {
+	args := make([]string, 0, len(words))
+	for _, w := range words {
+		for _, b := range braceExpand(w) {
+			args = append(args, sh.expandWord(b, true)...)
+		}
+	}
+	return args
+}
+
+// expandString раскрывает слово без разбиения на поля (например, значение в присваивании).
+func (sh *shell) expandString(w string) string {
+	return strings.Join(sh.expandWord(w, false), " ")
+}
+
+// expander накапливает поля, получающиеся при раскрытии слова.
+type expander struct {
+	sh     *shell
+	fields []string
+	cur    strings.Builder
+	// текущее поле начато - возможно, пустыми кавычками ""
+	started bool
+	// pattern - текущее поле как шаблон имён файлов: закавыченные символы в нём
+	// экранированы; globs[i] - шаблон поля fields[i] или "", если шаблона в нём нет
+	pattern strings.Builder
+	isGlob  bool
+	globs   []string
+}
+
+// add дописывает к текущему полю закавыченный текст.
+func (e *expander) add(s string) {
+	e.cur.WriteString(s)
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+			e.pattern.WriteByte('\\')
+		}
+		e.pattern.WriteByte(s[i])
+	}
+	e.started = true
+}
+
+// addUnquoted дописывает к текущему полю текст без кавычек: символы *, ? и [
+// в нём - шаблон имён файлов.
+func (e *expander) addUnquoted(s string) {
+	e.cur.WriteString(s)
+	e.pattern.WriteString(s)
+	e.isGlob = e.isGlob || strings.ContainsAny(s, "*?[")
+	e.started = true
+}
+
+// endField завершает текущее поле, если оно начато.
+func (e *expander) endField() {
+	if e.started {
+		e.fields = append(e.fields, e.cur.String())
+		glob := ""
+		if e.isGlob {
+			glob = e.pattern.String()
+		}
+		e.globs = append(e.globs, glob)
+		e.cur.Reset()
+		e.pattern.Reset()
+		e.started, e.isGlob = false, false
+	}
+}
+
+// addSplit дописывает результат незакавыченной подстановки, разбивая его на поля
+// по пробельным символам.
+func (e *expander) addSplit(s string) {
+	if s == "" {
+		return
+	}
+	if isSpace(s[0]) {
+		e.endField()
+	}
+	for i, f := range strings.Fields(s) {
+		if i > 0 {
+			e.endField()
+		}
+		e.addUnquoted(f)
+	}
+	if isSpace(s[len(s)-1]) {
+		e.endField()
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// expandWord раскрывает слово: подставляет переменные и параметры, убирает
+// кавычки и экранирование. Если split == true, результат незакавыченных
+// подстановок разбивается на поля, а поля с шаблонами заменяются именами
+// подходящих файлов (если таких нет, поле остаётся как есть).
+func (sh *shell) expandWord(w string, split bool) []string {
+	e := &expander{sh: sh}
+	for i := 0; i < len(w); i++ {
+		switch c := w[i]; c {
+		case '\\':
+			if i+1 < len(w) {
+				i++
+				e.add(w[i : i+1])
+			}
+		case '\'':
+			end := strings.IndexByte(w[i+1:], '\'')
+			e.add(w[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			if strings.HasPrefix(w[i:], `"$@"`) {
+				// "$@" раскрывается в отдельное поле для каждого позиционного параметра
+				for k, arg := range sh.args {
+					if k > 0 {
+						e.endField()
+					}
+					e.add(arg)
+				}
+				i += len(`"$@"`) - 1
+				continue
+			}
+			e.started = true
+			for i++; i < len(w) && w[i] != '"'; i++ {
+				switch {
+				case w[i] == '\\' && i+1 < len(w) && strings.IndexByte("$`\"\\", w[i+1]) >= 0:
+					// внутри двойных кавычек "\" экранирует только $ ` " \
+					i++
+					e.add(w[i : i+1])
+				case w[i] == '$':
+					i += e.param(w[i+1:], false)
+				default:
+					e.add(w[i : i+1])
+				}
+			}
+		case '$':
+			i += e.param(w[i+1:], split)
+		default:
+			e.addUnquoted(w[i : i+1])
+		}
+	}
+	e.endField()
+	if !split {
+		return e.fields
+	}
+	fields := make([]string, 0, len(e.fields))
+	for i, f := range e.fields {
+		if e.globs[i] != "" {
+			if matches := sh.glob(e.globs[i]); len(matches) > 0 {
+				fields = append(fields, matches...)
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// param раскрывает параметр, записанный после символа "$" в начале строки s:
+// $name, ${name}, $0..$9, $#, $@, $*, $$, $?. Возвращает число прочитанных байт после "$".
+func (e *expander) param(s string, split bool) int {
+	var name string
+	n := 0
+	switch {
+	case s == "":
+	case s[0] == '{':
+		if end := strings.IndexByte(s, '}'); end != -1 {
+			name, n = s[1:end], end+1
+		}
+	case isNameStart(s[0]):
+		n = 1
+		for n < len(s) && isNameChar(s[n]) {
+			n++
+		}
+		name = s[:n]
+	case s[0] >= '0' && s[0] <= '9', strings.IndexByte("#@*$?", s[0]) >= 0:
+		name, n = s[:1], 1
+	}
+	if n == 0 {
+		// после "$" нет имени - это обычный символ
+		e.add("$")
+		return 0
+	}
+	value := e.sh.lookupVar(name)
+	if split {
+		e.addSplit(value)
+	} else {
+		e.add(value)
+	}
+	return n
+}
+
+// braceExpand выполняет подстановку фигурных скобок в исходном (ещё не раскрытом)
+// слове: a{b,c}d -> abd acd, {1..3} -> 1 2 3, {a..c} -> a b c. Скобки в кавычках,
+// экранированные и ${...} не раскрываются; скобки без запятой и без диапазона
+// остаются как есть.
+func braceExpand(w string) []string {
+	for open := 0; open < len(w); open++ {
+		switch w[open] {
+		case '\\':
+			open++
+			continue
+		case '\'', '"':
+			open = skipQuoted(w, open)
+			continue
+		case '{':
+		default:
+			continue
+		}
+		if open > 0 && w[open-1] == '$' {
+			continue
+		}
+		alts, end := braceAlternatives(w, open)
+		if alts == nil {
+			continue
+		}
+		var words []string
+		for _, alt := range alts {
+			words = append(words, braceExpand(w[:open]+alt+w[end+1:])...)
+		}
+		return words
+	}
+	return []string{w}
+}
+
+// skipQuoted возвращает позицию закрывающей кавычки для кавычки в позиции i.
+func skipQuoted(w string, i int) int {
+	q := w[i]
+	for i++; i < len(w) && w[i] != q; i++ {
+		if q == '"' && w[i] == '\\' {
+			i++
+		}
+	}
+	return i
+}
+
+// braceAlternatives разбирает выражение в фигурных скобках, начинающееся в позиции
+// open, и возвращает варианты подстановки и позицию закрывающей скобки.
+// Если выражение не подлежит раскрытию, возвращает nil.
+func braceAlternatives(w string, open int) ([]string, int) {
+	depth := 0
+	var alts []string
+	start := open + 1
+	for i := open + 1; i < len(w); i++ {
+		switch w[i] {
+		case '\\':
+			i++
+		case '\'', '"':
+			i = skipQuoted(w, i)
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if alts == nil {
+				return braceSequence(w[start:i]), i
+			}
+			return append(alts, w[start:i]), i
+		case ',':
+			if depth == 0 {
+				alts = append(alts, w[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return nil, 0
+}
+
+// максимальное число элементов в раскрываемом диапазоне {x..y}: диапазон длиннее
+// остаётся словом как есть, а не съедает всю память
+const maxBraceItems = 1 << 20
+
+// braceSequence раскрывает диапазон x..y[..step] из чисел или одиночных букв.
+// Если у одной из границ есть ведущие нули, числа дополняются нулями до общей ширины.
+// Если диапазон длиннее maxBraceItems, возвращает nil.
+func braceSequence(s string) []string {
+	parts := strings.Split(s, "..")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil
+	}
+	// шаг и длина диапазона считаются без знака: для границ около MinInt и MaxInt
+	// их разность не помещается в int
+	var step uint64 = 1
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n == 0 {
+			return nil
+		}
+		if step = uint64(n); n < 0 {
+			step = -step
+		}
+	}
+	from, errFrom := strconv.Atoi(parts[0])
+	to, errTo := strconv.Atoi(parts[1])
+	width := 0
+	switch {
+	case errFrom == nil && errTo == nil:
+		for _, p := range parts[:2] {
+			if digits := strings.TrimPrefix(p, "-"); len(digits) > 1 && digits[0] == '0' && len(p) > width {
+				width = len(p)
+			}
+		}
+	case len(parts[0]) == 1 && len(parts[1]) == 1 && isLetter(parts[0][0]) && isLetter(parts[1][0]):
+		from, to = int(parts[0][0]), int(parts[1][0])
+		width = -1
+	default:
+		return nil
+	}
+	span := uint64(to) - uint64(from)
+	if from > to {
+		span = uint64(from) - uint64(to)
+	}
+	count := span/step + 1
+	if count > maxBraceItems {
+		return nil
+	}
+	seq := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		// все элементы лежат между from и to, так что приведение к int даёт точное значение
+		n := int(uint64(from) + i*step)
+		if from > to {
+			n = int(uint64(from) - i*step)
+		}
+		switch {
+		case width < 0:
+			seq = append(seq, string(rune(n)))
+		case width > 0:
+			seq = append(seq, fmt.Sprintf("%0*d", width, n))
+		default:
+			seq = append(seq, strconv.Itoa(n))
+		}
+	}
+	return seq
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// hasGlobMeta сообщает, есть ли в шаблоне неэкранированные символы *, ? или [.
+func hasGlobMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// glob возвращает отсортированный список путей, соответствующих шаблону.
+// Относительные шаблоны отсчитываются от текущего каталога оболочки, и найденные
+// пути тоже остаются относительными. Компонент ** соответствует любому числу
+// вложенных каталогов. Файлы, имена которых начинаются с точки, находятся,
+// только если точка указана в шаблоне явно.
+func (sh *shell) glob(pattern string) []string {
+	dir, prefix := sh.dir, ""
+	if strings.HasPrefix(pattern, "/") {
+		dir, prefix = "/", "/"
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	matches := globDir(dir, prefix, strings.Split(pattern, "/"))
+	sort.Strings(matches)
+	return matches
+}
+
+// globDir ищет в каталоге dir пути, соответствующие компонентам шаблона parts.
+// prefix - уже найденная часть пути, которая выводится перед совпадениями.
+func globDir(dir, prefix string, parts []string) []string {
+	part, rest := parts[0], parts[1:]
+	switch {
+	case part == "":
+		// шаблон заканчивается на "/" - совпадают только каталоги
+		if len(rest) == 0 {
+			return []string{prefix}
+		}
+		return globDir(dir, prefix, rest)
+	case part == "**":
+		if len(rest) == 0 {
+			rest = []string{"*"}
+		}
+		// ** может не соответствовать ни одному каталогу
+		matches := globDir(dir, prefix, rest)
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			// по символическим ссылкам не спускаемся, чтобы не зациклиться
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				matches = append(matches, globDir(filepath.Join(dir, entry.Name()), prefix+entry.Name()+"/", parts)...)
+			}
+		}
+		return matches
+	case !hasGlobMeta(part):
+		name := unescape(part)
+		p := filepath.Join(dir, name)
+		if len(rest) == 0 {
+			if _, err := os.Lstat(p); err != nil {
+				return nil
+			}
+			return []string{prefix + name}
+		}
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			return nil
+		}
+		return globDir(p, prefix+name+"/", rest)
+	}
+	// в шаблонах оболочки отрицание в классе символов - [!...], в filepath.Match - [^...]
+	pattern := strings.ReplaceAll(part, "[!", "[^")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(part, ".") {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, name); !ok {
+			continue
+		}
+		if len(rest) == 0 {
+			matches = append(matches, prefix+name)
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			matches = append(matches, globDir(p, prefix+name+"/", rest)...)
+		}
+	}
+	return matches
+}
+
+// lookupVar возвращает значение переменной или специального параметра.
+func (sh *shell) lookupVar(name string) string {
+	switch name {
+	case "#":
+		return strconv.Itoa(len(sh.args))
+	case "@", "*":
+		return strings.Join(sh.args, " ")
+	case "$":
+		return strconv.Itoa(os.Getpid())
+	case "?":
+		return strconv.Itoa(sh.status)
+	case "0":
+		return sh.name
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n >= 1 && n <= len(sh.args) {
+			return sh.args[n-1]
+		}
+		return ""
+	}
+	return sh.vars[name]
+}
+
+// prompt возвращает приглашение командной строки по формату из переменной PS1
+// (по умолчанию "\w$ "). Поддерживаются escape-последовательности bash:
+//
+//	\w, \W - текущий каталог (домашний заменяется на ~) и его последний компонент
+//	\u, \h, \H - имя пользователя, короткое и полное имя хоста
+//	\t, \T, \@, \A - время в форматах 24 ч, 12 ч, 12 ч с am/pm, ЧЧ:ММ; \d - дата
+//	\$ - "#" для root, иначе "$"; \s - имя оболочки; \j - число заданий
+//	\n, \e, \a, \\, \[ и \] (маркеры непечатаемых символов, опускаются)
+//
+// и дополнительно \g - текущая ветка git и \? - код завершения последней команды.
+// Параметры вида $NAME и $? тоже раскрываются.
+func (sh *shell) prompt() string {
+	format, ok := sh.vars["PS1"]
+	if !ok {
+		format = `\w$ `
+	}
+	return sh.expandPrompt(format)
+}
+
+// expandPrompt раскрывает escape-последовательности и параметры в формате приглашения.
+func (sh *shell) expandPrompt(format string) string {
+	e := &expander{sh: sh}
+	now := time.Now()
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c == '$' {
+			i += e.param(format[i+1:], false)
+			continue
+		}
+		if c != '\\' || i+1 == len(format) {
+			e.add(format[i : i+1])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'w':
+			e.add(sh.homeRelative(sh.dir))
+		case 'W':
+			if dir := sh.homeRelative(sh.dir); dir == "~" || dir == "/" {
+				e.add(dir)
+			} else {
+				e.add(filepath.Base(dir))
+			}
+		case 'u':
+			e.add(currentUser())
+		case 'h':
+			host, _ := os.Hostname()
+			e.add(strings.SplitN(host, ".", 2)[0])
+		case 'H':
+			host, _ := os.Hostname()
+			e.add(host)
+		case 't':
+			e.add(now.Format("15:04:05"))
+		case 'T':
+			e.add(now.Format("03:04:05"))
+		case '@':
+			e.add(now.Format("03:04 PM"))
+		case 'A':
+			e.add(now.Format("15:04"))
+		case 'd':
+			e.add(now.Format("Mon Jan 02"))
+		case '$':
+			if os.Geteuid() == 0 {
+				e.add("#")
+			} else {
+				e.add("$")
+			}
+		case 's':
+			e.add(filepath.Base(sh.name))
+		case 'j':
+			e.add(strconv.Itoa(len(sh.jobs)))
+		case 'g':
+			e.add(gitBranch(sh.dir))
+		case '?':
+			e.add(strconv.Itoa(sh.status))
+		case 'n':
+			e.add("\n")
+		case 'e':
+			e.add("\x1b")
+		case 'a':
+			e.add("\a")
+		case '\\':
+			e.add(`\`)
+		case '[', ']':
+		default:
+			e.add(format[i-1 : i+1])
+		}
+	}
+	return e.cur.String()
+}
+
+// homeRelative заменяет домашний каталог в начале пути на "~".
+func (sh *shell) homeRelative(dir string) string {
+	home := sh.vars["HOME"]
+	if home == "" || home == "/" {
+		return dir
+	}
+	if dir == home {
+		return "~"
+	}
+	if strings.HasPrefix(dir, home+"/") {
+		return "~" + dir[len(home):]
+	}
+	return dir
+}
+
+// currentUser возвращает имя текущего пользователя.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// gitBranch возвращает текущую ветку репозитория git, в котором находится dir,
+// или сокращённый хеш коммита, если HEAD отсоединён. Вне репозитория - пустая строка.
+func gitBranch(dir string) string {
+	for {
+		gitDir := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(gitDir); err == nil {
+			if !fi.IsDir() {
+				// в рабочем дереве (git worktree) и подмодуле .git - файл "gitdir: путь"
+				data, err := os.ReadFile(gitDir)
+				if err != nil {
+					return ""
+				}
+				gitDir = strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+				if !filepath.IsAbs(gitDir) {
+					gitDir = filepath.Join(dir, gitDir)
+				}
+			}
+			head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+			if err != nil {
+				return ""
+			}
+			ref := strings.TrimSpace(string(head))
+			if branch := strings.TrimPrefix(ref, "ref: refs/heads/"); branch != ref {
+				return branch
+			}
+			if len(ref) > 7 {
+				ref = ref[:7]
+			}
+			return ref
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// выводит строку на экран
+func echo(c cmdContext) error {
+	fmt.Fprintln(c.stdOut, strings.Join(c.args, " "))
+	return nil
+}
+
+// pwd выводит текущий путь
+func pwd(c cmdContext) error {
+	fmt.Fprintln(c.stdOut, c.sh.dir)
+	return nil
+}
+
+// сигналы в порядке номеров - для kill -l и разбора имён
+var signals = []struct {
+	name string
+	sig  syscall.Signal
+}{
+	{"HUP", syscall.SIGHUP}, {"INT", syscall.SIGINT}, {"QUIT", syscall.SIGQUIT},
+	{"ILL", syscall.SIGILL}, {"TRAP", syscall.SIGTRAP}, {"ABRT", syscall.SIGABRT},
+	{"BUS", syscall.SIGBUS}, {"FPE", syscall.SIGFPE}, {"KILL", syscall.SIGKILL},
+	{"USR1", syscall.SIGUSR1}, {"SEGV", syscall.SIGSEGV}, {"USR2", syscall.SIGUSR2},
+	{"PIPE", syscall.SIGPIPE}, {"ALRM", syscall.SIGALRM}, {"TERM", syscall.SIGTERM},
+	{"STKFLT", syscall.SIGSTKFLT}, {"CHLD", syscall.SIGCHLD}, {"CONT", syscall.SIGCONT},
+	{"STOP", syscall.SIGSTOP}, {"TSTP", syscall.SIGTSTP}, {"TTIN", syscall.SIGTTIN},
+	{"TTOU", syscall.SIGTTOU}, {"URG", syscall.SIGURG}, {"XCPU", syscall.SIGXCPU},
+	{"XFSZ", syscall.SIGXFSZ}, {"VTALRM", syscall.SIGVTALRM}, {"PROF", syscall.SIGPROF},
+	{"WINCH", syscall.SIGWINCH}, {"IO", syscall.SIGIO}, {"PWR", syscall.SIGPWR},
+	{"SYS", syscall.SIGSYS},
+}
+
+// parseSignal разбирает сигнал, заданный номером или именем (TERM, SIGTERM, term).
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	for _, sg := range signals {
+		if sg.name == name {
+			return sg.sig, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: invalid signal specification", s)
+}
+
+// signalName возвращает имя сигнала без префикса SIG.
+func signalName(sig syscall.Signal) string {
+	for _, sg := range signals {
+		if sg.sig == sig {
+			return sg.name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// kill посылает сигнал процессам или заданиям:
+// kill [-s SIGNAL | -SIGNAL] pid|%job... (по умолчанию SIGTERM).
+// kill -l [SIGNAL] выводит список сигналов или переводит номер в имя и обратно.
+func kill(c cmdContext) error {
+	args := c.args
+	if len(args) > 0 && args[0] == "-l" {
+		return listSignals(c.stdOut, args[1:])
+	}
+	sig := syscall.SIGTERM
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "--" {
+		spec := args[0][1:]
+		args = args[1:]
+		if spec == "s" || spec == "n" {
+			if len(args) == 0 {
+				return ErrMissingArgument
+			}
+			spec, args = args[0], args[1:]
+		}
+		var err error
+		if sig, err = parseSignal(spec); err != nil {
+			return err
+		}
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return ErrMissingArgument
+	}
+	failed := false
+	for _, target := range args {
+		if err := c.sh.signalTarget(target, sig); err != nil {
+			fmt.Fprintf(c.stdErr, "kill: %s: %v\n", target, err)
+			failed = true
+		}
+	}
+	if failed {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// signalTarget посылает сигнал заданию (%job) или процессу (pid; отрицательный pid -
+// группа процессов). Остановленное задание после сигнала завершения возобновляется,
+// чтобы оно могло его обработать.
+func (sh *shell) signalTarget(target string, sig syscall.Signal) error {
+	if strings.HasPrefix(target, "%") {
+		j, err := sh.findJob(target)
+		if err != nil {
+			return err
+		}
+		if err := j.signal(sig); err != nil {
+			return err
+		}
+		j.update()
+		if j.state == jobStopped && sig != syscall.SIGSTOP && sig != syscall.SIGTSTP &&
+			sig != syscall.SIGTTIN && sig != syscall.SIGTTOU && sig != 0 {
+			return j.signal(syscall.SIGCONT)
+		}
+		return nil
+	}
+	pid, err := strconv.Atoi(target)
+	if err != nil {
+		return errors.New("arguments must be process or job IDs")
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// listSignals реализует kill -l: без аргументов выводит таблицу сигналов,
+// для номера выводит имя сигнала, для имени - номер.
+func listSignals(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		for i, sg := range signals {
+			sep := "\t"
+			if (i+1)%5 == 0 || i == len(signals)-1 {
+				sep = "\n"
+			}
+			fmt.Fprintf(w, "%2d) SIG%-8s%s", int(sg.sig), sg.name, sep)
+		}
+		return nil
+	}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			// по коду завершения 128+N выводится имя сигнала, которым был убит процесс
+			if n > statusSignal {
+				n -= statusSignal
+			}
+			fmt.Fprintln(w, signalName(syscall.Signal(n)))
+			continue
+		}
+		sig, err := parseSignal(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, int(sig))
+	}
+	return nil
+}
+
+// procInfo - сведения о процессе, прочитанные из /proc.
+type procInfo struct {
+	pid, ppid int
+	uid       uint32
+	state     string
+	comm      string
+	args      []string
+	tty       int
+	// идентификатор сессии
+	session int
+	// процессорное время (user + system) и момент запуска после загрузки системы, в тактах
+	cpuTicks, startTicks uint64
+	// виртуальная память в байтах и резидентная - в страницах
+	vsize, rss uint64
+}
+
+// системные параметры для вычисления %CPU, %MEM и времени запуска
+type procSystem struct {
+	bootTime time.Time
+	uptime   float64
+	memTotal uint64
+}
+
+// clockTicks - число тактов в секунду (USER_HZ), в которых /proc/[pid]/stat считает
+// время процессов, то есть sysconf(_SC_CLK_TCK).
+var clockTicks = readClockTicks()
+
+// readClockTicks читает USER_HZ из вспомогательного вектора процесса (запись AT_CLKTCK
+// в /proc/self/auxv) - оттуда же его берёт sysconf в libc. Если вектор прочитать не
+// удалось, предполагается 100: таково значение USER_HZ на всех архитектурах Linux,
+// кроме alpha и ia64.
+func readClockTicks() uint64 {
+	const atClkTck = 17
+	auxv, err := os.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return 100
+	}
+	// вектор - последовательность пар машинных слов (тип, значение), заканчивающаяся AT_NULL
+	word := int(unsafe.Sizeof(uintptr(0)))
+	for i := 0; i+2*word <= len(auxv); i += 2 * word {
+		typ := *(*uintptr)(unsafe.Pointer(&auxv[i]))
+		val := *(*uintptr)(unsafe.Pointer(&auxv[i+word]))
+		if typ == 0 {
+			break
+		}
+		if typ == atClkTck && val > 0 {
+			return uint64(val)
+		}
+	}
+	return 100
+}
+
+// readProcs читает сведения обо всех процессах из /proc.
+func readProcs() ([]*procInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var procs []*procInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// процесс мог завершиться, пока мы читали каталог
+		if p, err := readProc(pid); err == nil {
+			procs = append(procs, p)
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].pid < procs[j].pid })
+	return procs, nil
+}
+
+// readProc читает /proc/[pid]/stat и /proc/[pid]/cmdline.
+func readProc(pid int) (*procInfo, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	data, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// имя команды в скобках может содержать пробелы и скобки, поэтому ищем последнюю ")"
+	stat := string(data)
+	open, closing := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if open < 0 || closing < open {
+		return nil, fmt.Errorf("%s/stat: unexpected format", dir)
+	}
+	// fields[0] - третье поле stat (state)
+	fields := strings.Fields(stat[closing+1:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("%s/stat: unexpected format", dir)
+	}
+	num := func(i int) uint64 {
+		n, _ := strconv.ParseUint(fields[i], 10, 64)
+		return n
+	}
+	p := &procInfo{
+		pid:        pid,
+		comm:       stat[open+1 : closing],
+		state:      fields[0],
+		cpuTicks:   num(11) + num(12),
+		startTicks: num(19),
+		vsize:      num(20),
+		rss:        num(21),
+	}
+	p.ppid, _ = strconv.Atoi(fields[1])
+	p.session, _ = strconv.Atoi(fields[3])
+	tty, _ := strconv.ParseInt(fields[4], 10, 64)
+	p.tty = int(tty)
+	if fi, err := os.Stat(dir); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			p.uid = st.Uid
+		}
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		p.args = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	}
+	return p, nil
+}
+
+// readProcSystem читает время загрузки, время работы системы и объём памяти.
+func readProcSystem() procSystem {
+	var sys procSystem
+	if data, err := os.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			sys.uptime, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	sys.bootTime = time.Now().Add(-time.Duration(sys.uptime * float64(time.Second)))
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "MemTotal:" {
+				kb, _ := strconv.ParseUint(fields[1], 10, 64)
+				sys.memTotal = kb * 1024
+			}
+		}
+	}
+	return sys
+}
+
+// ttyName переводит номер управляющего терминала из /proc/[pid]/stat в имя.
+func ttyName(tty int) string {
+	major, minor := (tty>>8)&0xfff, (tty&0xff)|((tty>>12)&0xfff00)
+	switch {
+	case tty == 0:
+		return "?"
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("pts/%d", minor+(major-136)*256)
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("tty%d", minor)
+	case major == 4:
+		return fmt.Sprintf("ttyS%d", minor-64)
+	}
+	return fmt.Sprintf("%d,%d", major, minor)
+}
+
+// userNames кэширует имена пользователей по uid. ps - встроенная команда и может
+// выполняться одновременно в нескольких горутинах (конвейеры, параллельные Run).
+var (
+	userNamesMu sync.Mutex
+	userNames   = map[uint32]string{}
+)
+
+// userName возвращает имя пользователя или uid, если имя не найдено.
+func userName(uid uint32) string {
+	userNamesMu.Lock()
+	defer userNamesMu.Unlock()
+	if name, ok := userNames[uid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(uid))
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	userNames[uid] = name
+	return name
+}
+
+// psColumn - колонка вывода ps: заголовок, выравнивание и способ получения значения.
+type psColumn struct {
+	header string
+	right  bool
+	value  func(p *procInfo, sys procSystem) string
+}
+
+// колонки ps по именам, принятым в -o
+var psColumns = map[string]psColumn{
+	"pid":  {"PID", true, func(p *procInfo, _ procSystem) string { return strconv.Itoa(p.pid) }},
+	"ppid": {"PPID", true, func(p *procInfo, _ procSystem) string { return strconv.Itoa(p.ppid) }},
+	"uid":  {"UID", true, func(p *procInfo, _ procSystem) string { return strconv.Itoa(int(p.uid)) }},
+	"user": {"USER", false, func(p *procInfo, _ procSystem) string { return userName(p.uid) }},
+	"stat": {"STAT", false, func(p *procInfo, _ procSystem) string { return p.state }},
+	"tty":  {"TTY", false, func(p *procInfo, _ procSystem) string { return ttyName(p.tty) }},
+	"%cpu": {"%CPU", true, func(p *procInfo, sys procSystem) string {
+		elapsed := sys.uptime - float64(p.startTicks)/float64(clockTicks)
+		if elapsed <= 0 {
+			return "0.0"
+		}
+		return strconv.FormatFloat(float64(p.cpuTicks)/float64(clockTicks)/elapsed*100, 'f', 1, 64)
+	}},
+	"%mem": {"%MEM", true, func(p *procInfo, sys procSystem) string {
+		if sys.memTotal == 0 {
+			return "0.0"
+		}
+		rss := float64(p.rss) * float64(os.Getpagesize())
+		return strconv.FormatFloat(rss/float64(sys.memTotal)*100, 'f', 1, 64)
+	}},
+	"vsz": {"VSZ", true, func(p *procInfo, _ procSystem) string { return strconv.FormatUint(p.vsize/1024, 10) }},
+	"rss": {"RSS", true, func(p *procInfo, _ procSystem) string {
+		return strconv.FormatUint(p.rss*uint64(os.Getpagesize())/1024, 10)
+	}},
+	"start": {"START", false, func(p *procInfo, sys procSystem) string {
+		started := sys.bootTime.Add(time.Duration(p.startTicks) * time.Second / time.Duration(clockTicks))
+		if y, m, d := started.Date(); y == time.Now().Year() && m == time.Now().Month() && d == time.Now().Day() {
+			return started.Format("15:04")
+		}
+		return started.Format("Jan02")
+	}},
+	"time": {"TIME", false, func(p *procInfo, _ procSystem) string {
+		sec := p.cpuTicks / clockTicks
+		return fmt.Sprintf("%02d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+	}},
+	"comm": {"COMMAND", false, func(p *procInfo, _ procSystem) string { return p.comm }},
+	"args": {"COMMAND", false, func(p *procInfo, _ procSystem) string {
+		if len(p.args) == 0 {
+			return "[" + p.comm + "]"
+		}
+		return strings.Join(p.args, " ")
+	}},
+}
+
+// синонимы имён колонок
+var psAliases = map[string]string{
+	"state": "stat", "s": "stat", "pcpu": "%cpu", "pmem": "%mem", "stime": "start",
+	"cmd": "args", "command": "args", "ucmd": "comm", "tname": "tty", "tt": "tty",
+}
+
+// стандартные наборы колонок ps
+var (
+	psDefaultFormat = []string{"pid", "tty", "time", "comm"}
+	psFullFormat    = []string{"user", "pid", "ppid", "%cpu", "start", "tty", "time", "args"}
+	psUserFormat    = []string{"user", "pid", "%cpu", "%mem", "vsz", "rss", "tty", "stat", "start", "time", "args"}
+)
+
+// psOptions - разобранные аргументы ps.
+type psOptions struct {
+	// all - все процессы, а не только процессы пользователя на этом терминале
+	all    bool
+	forest bool
+	// имена колонок после раскрытия синонимов
+	columns []string
+}
+
+// parsePSArgs разбирает аргументы ps: -e (-A) - все процессы, -f - полный формат,
+// -o col,... - выбор колонок (можно повторять), -H (--forest) - дерево процессов,
+// а также BSD-форму без "-": a и x - все процессы, u - формат с пользователем, f - дерево.
+func parsePSArgs(args []string) (psOptions, error) {
+	var opts psOptions
+	format := psDefaultFormat
+	var custom []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--forest":
+			opts.forest = true
+		case arg == "-o":
+			if i+1 == len(args) {
+				return opts, ErrMissingArgument
+			}
+			i++
+			custom = append(custom, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(arg, "-o"):
+			custom = append(custom, strings.Split(arg[2:], ",")...)
+		case strings.HasPrefix(arg, "-"):
+			for _, f := range arg[1:] {
+				switch f {
+				case 'e', 'A':
+					opts.all = true
+				case 'f':
+					format = psFullFormat
+				case 'H':
+					opts.forest = true
+				default:
+					return opts, fmt.Errorf("-%c: unknown option", f)
+				}
+			}
+		default:
+			for _, f := range arg {
+				switch f {
+				case 'a', 'x':
+					opts.all = true
+				case 'u':
+					format = psUserFormat
+				case 'f':
+					opts.forest = true
+				default:
+					return opts, fmt.Errorf("%c: unknown option", f)
+				}
+			}
+		}
+	}
+	if custom != nil {
+		format = custom
+	}
+	for _, name := range format {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := psAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := psColumns[name]; !ok {
+			return opts, fmt.Errorf("%s: unknown column", name)
+		}
+		opts.columns = append(opts.columns, name)
+	}
+	return opts, nil
+}
+
+// sameTerminal сообщает, относится ли процесс p к тому же терминалу, что и self.
+// Без управляющего терминала номер tty у всех таких процессов нулевой, и вместо
+// него сравнивается сессия - иначе в список попали бы все демоны пользователя.
+func sameTerminal(p, self *procInfo) bool {
+	if self.tty == 0 {
+		return p.session == self.session
+	}
+	return p.tty == self.tty
+}
+
+// ps выводит список процессов, читая /proc (аргументы - см. parsePSArgs).
+// По умолчанию показываются процессы текущего пользователя на том же терминале
+// (без терминала - в той же сессии).
+func ps(c cmdContext) error {
+	opts, err := parsePSArgs(c.args)
+	if err != nil {
+		return err
+	}
+	all, forest := opts.all, opts.forest
+	columns := make([]psColumn, len(opts.columns))
+	for i, name := range opts.columns {
+		columns[i] = psColumns[name]
+	}
+
+	procs, err := readProcs()
+	if err != nil {
+		return err
+	}
+	if !all {
+		self, err := readProc(os.Getpid())
+		if err != nil {
+			return err
+		}
+		uid := uint32(os.Geteuid())
+		var own []*procInfo
+		for _, p := range procs {
+			if p.uid == uid && sameTerminal(p, self) {
+				own = append(own, p)
+			}
+		}
+		procs = own
+	}
+	var depths []int
+	if forest {
+		procs, depths = procTree(procs)
+	}
+
+	sys := readProcSystem()
+	rows := [][]string{make([]string, len(columns))}
+	for i, col := range columns {
+		rows[0][i] = col.header
+	}
+	for n, p := range procs {
+		row := make([]string, len(columns))
+		for i, col := range columns {
+			row[i] = col.value(p, sys)
+		}
+		if forest && depths[n] > 0 {
+			// в дереве отступ получает последняя колонка - обычно команда
+			last := len(row) - 1
+			row[last] = strings.Repeat("    ", depths[n]-1) + " \\_ " + row[last]
+		}
+		rows = append(rows, row)
+	}
+	writeTable(c.stdOut, rows, columns)
+	return nil
+}
+
+// procTree упорядочивает процессы обходом дерева в глубину и возвращает глубину
+// каждого. Корнями считаются процессы, родителя которых нет в списке.
+func procTree(procs []*procInfo) ([]*procInfo, []int) {
+	present := make(map[int]bool, len(procs))
+	for _, p := range procs {
+		present[p.pid] = true
+	}
+	children := make(map[int][]*procInfo)
+	var roots []*procInfo
+	for _, p := range procs {
+		if present[p.ppid] && p.ppid != p.pid {
+			children[p.ppid] = append(children[p.ppid], p)
+		} else {
+			roots = append(roots, p)
+		}
+	}
+	sorted := make([]*procInfo, 0, len(procs))
+	depths := make([]int, 0, len(procs))
+	var walk func(p *procInfo, depth int)
+	walk = func(p *procInfo, depth int) {
+		sorted = append(sorted, p)
+		depths = append(depths, depth)
+		for _, child := range children[p.pid] {
+			walk(child, depth+1)
+		}
+	}
+	for _, p := range roots {
+		walk(p, 0)
+	}
+	return sorted, depths
+}
+
+// writeTable выводит таблицу, выравнивая колонки по ширине. Последняя колонка
+// не дополняется пробелами.
+func writeTable(w io.Writer, rows [][]string, columns []psColumn) {
+	widths := make([]int, len(columns))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		var sb strings.Builder
+		for i, cell := range row {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			pad := strings.Repeat(" ", widths[i]-len(cell))
+			switch {
+			case columns[i].right:
+				sb.WriteString(pad + cell)
+			case i == len(row)-1:
+				sb.WriteString(cell)
+			default:
+				sb.WriteString(cell + pad)
+			}
+		}
+		fmt.Fprintln(w, sb.String())
+	}
+}
+
+// nc - клиент и сервер netcat:
+//
+//	nc [-u] [-v] [-w timeout] host port       - соединиться и передавать stdin в соединение, а данные из него - в stdout
+//	nc -l [-u] [-v] [-w timeout] [host] port  - принять одно соединение (или датаграммы UDP) и работать так же
+//	nc -z [-u] [-v] [-w timeout] host port[-port]... - проверить, какие порты открыты
+//
+// По концу ввода соединение TCP закрывается на запись (half-close), а nc ждёт, пока
+// закроется другая сторона. -w задаёт время ожидания соединения и максимальное время
+// простоя в секундах; сеанс UDP без -w продолжается до прерывания.
+func nc(c cmdContext) error {
+	fs := flag.NewFlagSet("nc", flag.ContinueOnError)
+	fs.SetOutput(c.stdErr)
+	udp := fs.Bool("u", false, "use UDP instead of TCP")
+	listen := fs.Bool("l", false, "listen for an incoming connection")
+	scan := fs.Bool("z", false, "only scan for listening daemons")
+	verbose := fs.Bool("v", false, "report connection status to stderr")
+	port := fs.String("p", "", "local port to listen on")
+	wait := fs.Float64("w", 0, "connect and idle `timeout` in seconds")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: nc [-uvz] [-w timeout] host port[-port]...\n       nc -l [-uv] [-w timeout] [-p port] [host] [port]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(c.args); err != nil {
+		return &statusError{statusFailure}
+	}
+	network := "tcp"
+	if *udp {
+		network = "udp"
+	}
+	timeout := time.Duration(*wait * float64(time.Second))
+	args := fs.Args()
+
+	ctx, cancel := c.sh.interruptContext()
+	defer cancel()
+	var err error
+	switch {
+	case *listen:
+		host := ""
+		if *port == "" && len(args) > 0 {
+			*port, args = args[len(args)-1], args[:len(args)-1]
+		}
+		if len(args) > 0 {
+			host = args[0]
+		}
+		if *port == "" || len(args) > 1 {
+			fs.Usage()
+			return &statusError{statusFailure}
+		}
+		err = ncListen(ctx, c, network, net.JoinHostPort(host, *port), timeout, *verbose)
+	case len(args) < 2:
+		fs.Usage()
+		return &statusError{statusFailure}
+	case *scan:
+		err = ncScan(ctx, c, network, args[0], args[1:], timeout, *verbose)
+	default:
+		err = ncConnect(ctx, c, network, net.JoinHostPort(args[0], args[1]), timeout, *verbose)
+	}
+	if ctx.Err() != nil {
+		// отмена контекста оболочки прерывает выполнение, Ctrl+C - только nc
+		if c.sh.ctx.Err() != nil {
+			return c.sh.ctx.Err()
+		}
+		fmt.Fprintln(c.stdOut)
+		return ErrInterrupted
+	}
+	return err
+}
+
+// interruptContext возвращает контекст, отменяемый вместе с контекстом оболочки, а
+// если оболочка перехватывает сигналы - ещё и по сигналу, прерывающему команды
+// (Ctrl+C, сигнал с обработчиком trap): встроенные команды выполняются в самой
+// оболочке, и иначе прервать долгую встроенную команду было бы нельзя.
+func (sh *shell) interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(sh.ctx)
+	if sh.signals == nil {
+		return ctx, cancel
+	}
+	arrived := sh.signals.wait()
+	go func() {
+		select {
+		case <-arrived:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// ncConnect соединяется с addr и передаёт данные в обе стороны.
+func ncConnect(ctx context.Context, c cmdContext, network, addr string, timeout time.Duration, verbose bool) error {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Fprintf(c.stdErr, "Connection to %s [%s] succeeded!\n", addr, network)
+	}
+	return ncTransfer(ctx, conn, c.stdin, c.stdOut, timeout)
+}
+
+// ncListen ожидает одно входящее соединение TCP или первую датаграмму UDP на addr
+// и передаёт данные в обе стороны.
+func ncListen(ctx context.Context, c cmdContext, network, addr string, timeout time.Duration, verbose bool) error {
+	if network == "udp" {
+		pc, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+		if verbose {
+			fmt.Fprintf(c.stdErr, "Bound on %s\n", pc.LocalAddr())
+		}
+		return ncTransfer(ctx, newPacketConn(pc), c.stdin, c.stdOut, timeout)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Fprintf(c.stdErr, "Listening on %s\n", ln.Addr())
+	}
+	// Accept не принимает контекст: прерываем ожидание, закрывая сокет
+	accepted := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-accepted:
+		}
+	}()
+	conn, err := ln.Accept()
+	close(accepted)
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Fprintf(c.stdErr, "Connection received on %s\n", conn.RemoteAddr())
+	}
+	return ncTransfer(ctx, conn, c.stdin, c.stdOut, timeout)
+}
+
+// packetConn позволяет вести сеанс UDP на слушающем сокете как обычное соединение:
+// собеседником становится отправитель первой датаграммы, датаграммы от других адресов
+// отбрасываются.
+type packetConn struct {
+	pc net.PacketConn
+	mu sync.Mutex
+	// адрес собеседника; до первой датаграммы писать некуда,
+	// поэтому Write ждёт закрытия ready
+	peer  net.Addr
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newPacketConn(pc net.PacketConn) *packetConn {
+	return &packetConn{pc: pc, ready: make(chan struct{})}
+}
+
+func (p *packetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := p.pc.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		p.mu.Lock()
+		if p.peer == nil {
+			p.peer = addr
+		}
+		ok := p.peer.String() == addr.String()
+		p.mu.Unlock()
+		if ok {
+			p.once.Do(func() { close(p.ready) })
+			return n, nil
+		}
+	}
+}
+
+// Write отправляет датаграмму собеседнику, дожидаясь, пока он станет известен.
+func (p *packetConn) Write(b []byte) (int, error) {
+	<-p.ready
+	p.mu.Lock()
+	peer := p.peer
+	p.mu.Unlock()
+	if peer == nil {
+		return 0, net.ErrClosed
+	}
+	return p.pc.WriteTo(b, peer)
+}
+
+func (p *packetConn) Close() error {
+	// разблокируем Write, ждущий собеседника
+	p.once.Do(func() { close(p.ready) })
+	return p.pc.Close()
+}
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	return p.pc.SetReadDeadline(t)
+}
+
+// ncConn - соединение, с которым работает nc: net.Conn или packetConn.
+type ncConn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// ncTransfer передаёт данные из in в conn и из conn в out, пока не закончатся
+// оба направления, не истечёт время простоя idle (если задано) или не будет отменён ctx.
+// По концу in соединение TCP закрывается на запись; если другая сторона закрыла
+// соединение раньше, отправка продолжается до конца in или до ошибки записи.
+func ncTransfer(ctx context.Context, conn ncConn, in io.Reader, out io.Writer, idle time.Duration) error {
+	defer conn.Close()
+	// время последней передачи данных в любую сторону, в наносекундах Unix
+	var lastActive int64 = time.Now().UnixNano()
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+
+	done := make(chan struct{})
+	defer close(done)
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(writerFunc(func(b []byte) (int, error) {
+			touch()
+			return conn.Write(b)
+		}), newInterruptibleReader(in, done))
+		if err == nil {
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				err = cw.CloseWrite()
+			}
+		}
+		sendErr <- err
+	}()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			if idle > 0 {
+				conn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&lastActive)).Add(idle))
+			}
+			n, err := conn.Read(buf)
+			if n > 0 {
+				touch()
+				if _, err := out.Write(buf[:n]); err != nil {
+					recvErr <- err
+					return
+				}
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// пока мы ждали, могли отправляться данные - тогда простоя нет
+				if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < idle {
+					continue
+				}
+				recvErr <- errIdle
+				return
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	received, sent := false, false
+	for !received || !sent {
+		select {
+		case err := <-recvErr:
+			if err == errIdle {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			received = true
+		case err := <-sendErr:
+			if err != nil {
+				return err
+			}
+			sent = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// errIdle сообщает об истечении времени простоя сеанса nc.
+var errIdle = errors.New("idle timeout")
+
+// writerFunc превращает функцию в io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// interruptibleReader читает из r, но перестаёт ждать ввода, когда закрыт канал done,
+// и возвращает io.EOF. Для файлов ожидание идёт через select(2), поэтому горутина не
+// остаётся висеть на чтении - иначе, например, при чтении с терминала она перехватила
+// бы следующую команду, введённую в оболочку.
+type interruptibleReader struct {
+	r    io.Reader
+	fd   int
+	done <-chan struct{}
+}
+
+func newInterruptibleReader(r io.Reader, done <-chan struct{}) *interruptibleReader {
+	ir := &interruptibleReader{r: r, fd: -1, done: done}
+	if f, ok := r.(*os.File); ok {
+		if rc, err := f.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) { ir.fd = int(fd) })
+		}
+	}
+	return ir
+}
+
+func (ir *interruptibleReader) Read(b []byte) (int, error) {
+	var set syscall.FdSet
+	for ir.fd >= 0 && ir.fd < len(set.Bits)*64 {
+		select {
+		case <-ir.done:
+			return 0, io.EOF
+		default:
+		}
+		set = syscall.FdSet{}
+		set.Bits[ir.fd/64] |= 1 << (uint(ir.fd) % 64)
+		tv := syscall.Timeval{Usec: 100000}
+		n, err := syscall.Select(ir.fd+1, &set, nil, nil, &tv)
+		if err == syscall.EINTR || (err == nil && n == 0) {
+			continue
+		}
+		break
+	}
+	select {
+	case <-ir.done:
+		return 0, io.EOF
+	default:
+	}
+	return ir.r.Read(b)
+}
+
+// ncScan проверяет порты host: ports - номера или диапазоны вида 20-25.
+// Для TCP порт открыт, если удалось соединиться; для UDP - если в ответ на пустую
+// датаграмму не пришло сообщение о недоступности порта. Код завершения 0,
+// если открыт хотя бы один порт.
+func ncScan(ctx context.Context, c cmdContext, network, host string, ports []string, timeout time.Duration, verbose bool) error {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	open := false
+	for _, spec := range ports {
+		first, last, err := parsePortRange(spec)
+		if err != nil {
+			return err
+		}
+		for port := first; port <= last; port++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			addr := net.JoinHostPort(host, strconv.Itoa(port))
+			err := probePort(ctx, network, addr, timeout)
+			if err == nil {
+				open = true
+				if verbose {
+					fmt.Fprintf(c.stdErr, "Connection to %s port %d [%s] succeeded!\n", host, port, network)
+				}
+			} else if verbose {
+				fmt.Fprintf(c.stdErr, "nc: connect to %s port %d (%s) failed: %v\n", host, port, network, err)
+			}
+		}
+	}
+	if !open {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// probePort проверяет, открыт ли порт.
+func probePort(ctx context.Context, network, addr string, timeout time.Duration) error {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if network != "udp" {
+		return nil
+	}
+	// о закрытом порте UDP сообщает ICMP: он проявится как ошибка при чтении
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout / 5))
+	_, err = conn.Read(make([]byte, 1))
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// parsePortRange разбирает номер порта или диапазон first-last.
+func parsePortRange(spec string) (first, last int, err error) {
+	from, to, isRange := strings.Cut(spec, "-")
+	if first, err = strconv.Atoi(from); err == nil && isRange {
+		last, err = strconv.Atoi(to)
+	} else {
+		last = first
+	}
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("%s: invalid port range", spec)
+	}
+	return first, last, nil
+}
+
+// cd меняет текущий каталог оболочки. Без аргументов переходит в $HOME,
+// "cd -" возвращает в предыдущий каталог ($OLDPWD) и выводит его.
+func cd(c cmdContext) error {
+	sh := c.sh
+	var dir string
+	switch {
+	case len(c.args) == 0:
+		if dir = sh.vars["HOME"]; dir == "" {
+			return errors.New("HOME not set")
+		}
+	case c.args[0] == "-":
+		if dir = sh.vars["OLDPWD"]; dir == "" {
+			return errors.New("OLDPWD not set")
+		}
+	default:
+		dir = c.args[0]
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(sh.dir, dir)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	sh.vars["OLDPWD"] = sh.dir
+	sh.dir = filepath.Clean(dir)
+	sh.vars["PWD"] = sh.dir
+	sh.exported["OLDPWD"], sh.exported["PWD"] = true, true
+	if len(c.args) > 0 && c.args[0] == "-" {
+		fmt.Fprintln(c.stdOut, sh.dir)
+	}
+	return nil
+}
+
+// exit завершает работу оболочки с кодом N (по умолчанию - с кодом последней команды).
+func exit(c cmdContext) error {
+	if len(c.args) > 0 {
+		n, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			fmt.Fprintf(c.stdErr, "exit: %s: numeric argument required\n", c.args[0])
+			n = statusSyntax
+		}
+		c.sh.status = n & 0xff
+	}
+	return ErrExit
+}
+
+// loopLevel разбирает необязательный аргумент break/continue - число циклов.
+func loopLevel(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s: loop count out of range", args[0])
+	}
+	return n, nil
+}
+
+// breakLoop прерывает выполнение n вложенных циклов.
+func breakLoop(c cmdContext) error {
+	n, err := loopLevel(c.args)
+	if err != nil {
+		return err
+	}
+	return &loopControl{n: n}
+}
+
+// continueLoop переходит к следующей итерации n-го объемлющего цикла.
+func continueLoop(c cmdContext) error {
+	n, err := loopLevel(c.args)
+	if err != nil {
+		return err
+	}
+	return &loopControl{n: n, cont: true}
+}
+
+// returnFunc завершает функцию с указанным кодом (по умолчанию - код последней команды).
+func returnFunc(c cmdContext) error {
+	status := c.sh.status
+	if len(c.args) > 0 {
+		n, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			return fmt.Errorf("%s: numeric argument required", c.args[0])
+		}
+		status = n
+	}
+	return &returnControl{status: status}
+}
+
+// jobs выводит список заданий.
+func jobs(c cmdContext) error {
+	for _, j := range c.sh.jobs {
+		j.update()
+		fmt.Fprintln(c.stdOut, c.sh.formatJob(j))
+	}
+	return nil
+}
+
+// jobSpec возвращает спецификацию задания из аргументов команды (по умолчанию - текущее).
+func jobSpec(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// fg переводит задание на передний план, при необходимости возобновляя его.
+func fg(c cmdContext) error {
+	j, err := c.sh.findJob(jobSpec(c.args))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdOut, j.text)
+	if c.sh.jobControl && j.pgid != 0 {
+		if err := tcsetpgrp(c.sh.ttyFd, j.pgid); err != nil {
+			return err
+		}
+	}
+	if j.state == jobStopped {
+		for _, p := range j.procs {
+			p.stopped = false
+		}
+		if err := j.signal(syscall.SIGCONT); err != nil {
+			return err
+		}
+	}
+	_, err = c.sh.waitForeground(j, c.std)
+	return err
+}
+
+// bg возобновляет остановленное задание в фоне.
+func bg(c cmdContext) error {
+	j, err := c.sh.findJob(jobSpec(c.args))
+	if err != nil {
+		return err
+	}
+	if j.state != jobStopped {
+		return fmt.Errorf("job %d already in background", j.id)
+	}
+	for _, p := range j.procs {
+		p.stopped = false
+	}
+	j.state, j.reported = jobRunning, jobRunning
+	fmt.Fprintf(c.stdOut, "[%d]%s %s &\n", j.id, c.sh.jobMark(j), j.text)
+	return j.signal(syscall.SIGCONT)
+}
+
+// wait ожидает завершения указанных заданий (%n) или процессов (pid),
+// а без аргументов - всех фоновых заданий. Возвращает код завершения последнего
+// из указанных заданий; ожидание прерывается сигналом с кодом 128 + номер сигнала.
+func wait(c cmdContext) error {
+	sh := c.sh
+	var waiting []*job
+	if len(c.args) == 0 {
+		waiting = append(waiting, sh.jobs...)
+	}
+	for _, spec := range c.args {
+		pid, err := strconv.Atoi(spec)
+		if err != nil {
+			j, err := sh.findJob(spec)
+			if err != nil {
+				return err
+			}
+			waiting = append(waiting, j)
+			continue
+		}
+		// ищем задание, которому принадлежит процесс
+		var found *job
+		for _, j := range sh.jobs {
+			for _, p := range j.procs {
+				if p.pid == pid {
+					found = j
+				}
+			}
+		}
+		if found == nil {
+			fmt.Fprintf(c.stdErr, "wait: pid %d is not a child of this shell\n", pid)
+			return &statusError{statusNotFound}
+		}
+		waiting = append(waiting, found)
+	}
+
+	ctx, cancel := sh.interruptContext()
+	defer cancel()
+	status := 0
+	for _, j := range waiting {
+		if err := waitJob(ctx, j); err != nil {
+			if sh.ctx.Err() != nil {
+				return sh.ctx.Err()
+			}
+			return &statusError{statusSignal + int(sh.signals.lastSignal())}
+		}
+		if err := j.waitErr(); err != nil {
+			fmt.Fprintf(c.stdErr, "wait: %v\n", err)
+		}
+		status = j.exitStatus()
+	}
+	if len(c.args) == 0 {
+		return nil
+	}
+	return exitWith(status)
+}
+
+// waitJob ожидает завершения или остановки задания, периодически опрашивая его,
+// чтобы ожидание можно было прервать отменой ctx.
+func waitJob(ctx context.Context, j *job) error {
+	for {
+		j.update()
+		if j.state != jobRunning {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// trap задаёт команды, которые оболочка выполнит при получении сигнала или при выходе (EXIT):
+//
+//	trap 'команды' SIGNAL...  - установить обработчик
+//	trap '' SIGNAL...         - игнорировать сигнал
+//	trap - SIGNAL...          - восстановить действие по умолчанию
+//	trap [-p [SIGNAL...]]     - вывести обработчики
+//	trap -l                   - вывести список сигналов
+func trap(c cmdContext) error {
+	sh := c.sh
+	args := c.args
+	if len(args) > 0 {
+		switch args[0] {
+		case "-l":
+			return listSignals(c.stdOut, args[1:])
+		case "-p":
+			return sh.printTraps(c.stdOut, args[1:])
+		case "--":
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return sh.printTraps(c.stdOut, nil)
+	}
+	action, specs := args[0], args[1:]
+	if len(specs) == 0 {
+		// trap SIGNAL сбрасывает обработчик
+		if _, err := parseTrapSignal(action); err != nil {
+			return ErrMissingArgument
+		}
+		action, specs = "-", args
+	}
+	failed := false
+	for _, spec := range specs {
+		sig, err := parseTrapSignal(spec)
+		if err == nil && (sig == syscall.SIGKILL || sig == syscall.SIGSTOP) {
+			err = errors.New("signal cannot be trapped")
+		}
+		if err != nil {
+			fmt.Fprintf(c.stdErr, "trap: %s: %v\n", spec, err)
+			failed = true
+			continue
+		}
+		if action == "-" {
+			delete(sh.traps, sig)
+		} else {
+			sh.traps[sig] = action
+		}
+		if sig != 0 && sh.signals != nil {
+			sh.signals.setTrap(sig, action)
+		}
+	}
+	if failed {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// parseTrapSignal разбирает сигнал для trap: кроме сигналов допускается EXIT (или 0).
+func parseTrapSignal(s string) (syscall.Signal, error) {
+	if strings.EqualFold(s, "EXIT") {
+		return 0, nil
+	}
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, errors.New("invalid signal specification")
+	}
+	return sig, nil
+}
+
+// printTraps выводит обработчики в виде команд trap, которые их устанавливают.
+func (sh *shell) printTraps(w io.Writer, specs []string) error {
+	sigs := make([]syscall.Signal, 0, len(sh.traps))
+	for sig := range sh.traps {
+		sigs = append(sigs, sig)
+	}
+	if len(specs) > 0 {
+		sigs = sigs[:0]
+		for _, spec := range specs {
+			sig, err := parseTrapSignal(spec)
+			if err != nil {
+				return fmt.Errorf("%s: %w", spec, err)
+			}
+			if _, ok := sh.traps[sig]; ok {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	sort.Slice(sigs, func(i, j int) bool { return sigs[i] < sigs[j] })
+	for _, sig := range sigs {
+		name := "EXIT"
+		if sig != 0 {
+			name = "SIG" + signalName(sig)
+		}
+		fmt.Fprintf(w, "trap -- %s %s\n", shellQuote(sh.traps[sig]), name)
+	}
+	return nil
+}
+
+// export помечает переменные как экспортируемые: они передаются в окружение
+// внешних программ. Без аргументов выводит экспортированные переменные.
+func export(c cmdContext) error {
+	sh := c.sh
+	if len(c.args) == 0 || (len(c.args) == 1 && c.args[0] == "-p") {
+		for _, name := range sortedKeys(sh.vars) {
+			if sh.exported[name] {
+				fmt.Fprintf(c.stdOut, "export %s=%s\n", name, shellQuote(sh.vars[name]))
+			}
+		}
+		return nil
+	}
+	var err error
+	for _, arg := range c.args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isName(name) {
+			err = fmt.Errorf("`%s': not a valid identifier", arg)
+			fmt.Fprintf(c.stdErr, "export: %v\n", err)
+			continue
+		}
+		if hasValue {
+			sh.vars[name] = value
+		}
+		sh.exported[name] = true
+	}
+	if err != nil {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// unset удаляет переменные (-v, по умолчанию) или функции (-f). Если переменной
+// с таким именем нет, без флагов удаляется функция.
+func unset(c cmdContext) error {
+	sh := c.sh
+	vars, funcs := true, true
+	args := c.args
+	if len(args) > 0 && (args[0] == "-v" || args[0] == "-f") {
+		vars, funcs = args[0] == "-v", args[0] == "-f"
+		args = args[1:]
+	}
+	for _, name := range args {
+		if _, ok := sh.vars[name]; ok && vars {
+			delete(sh.vars, name)
+			delete(sh.exported, name)
+			continue
+		}
+		if funcs {
+			delete(sh.funcs, name)
+		}
+	}
+	return nil
+}
+
+// env без аргументов выводит окружение, которое получат внешние программы.
+// env NAME=value... command args... запускает команду с дополнительными переменными.
+func env(c cmdContext) error {
+	args := c.args
+	var assigns []string
+	for len(args) > 0 && strings.Contains(args[0], "=") {
+		assigns = append(assigns, args[0])
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		for _, kv := range c.sh.environ(assigns) {
+			fmt.Fprintln(c.stdOut, kv)
+		}
+		return nil
+	}
+	status, err := c.sh.runSimple(args, assigns, c.std)
+	if err != nil {
+		return err
+	}
+	return exitWith(status)
+}
+
+// set без аргументов выводит все переменные оболочки, с аргументами - заменяет
+// позиционные параметры: set [--] args...
+func set(c cmdContext) error {
+	if len(c.args) == 0 {
+		for _, name := range sortedKeys(c.sh.vars) {
+			fmt.Fprintf(c.stdOut, "%s=%s\n", name, shellQuote(c.sh.vars[name]))
+		}
+		return nil
+	}
+	args := c.args
+	switch {
+	case args[0] == "--":
+		args = args[1:]
+	case strings.HasPrefix(args[0], "-") || strings.HasPrefix(args[0], "+"):
+		return fmt.Errorf("%s: unsupported option", args[0])
+	}
+	c.sh.args = append([]string(nil), args...)
+	return nil
+}
+
+// alias задаёт псевдонимы команд: alias name=value. Без аргументов выводит все
+// псевдонимы, с одним именем - значение псевдонима.
+func alias(c cmdContext) error {
+	sh := c.sh
+	if len(c.args) == 0 {
+		for _, name := range sortedKeys(sh.aliases) {
+			fmt.Fprintf(c.stdOut, "alias %s=%s\n", name, shellQuote(sh.aliases[name]))
+		}
+		return nil
+	}
+	var err error
+	for _, arg := range c.args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		switch {
+		case hasValue:
+			sh.aliases[name] = value
+		case sh.aliases[name] != "":
+			fmt.Fprintf(c.stdOut, "alias %s=%s\n", name, shellQuote(sh.aliases[name]))
+		default:
+			err = fmt.Errorf("%s: not found", name)
+			fmt.Fprintf(c.stdErr, "alias: %v\n", err)
+		}
+	}
+	if err != nil {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// unalias удаляет псевдонимы; unalias -a удаляет все.
+func unalias(c cmdContext) error {
+	sh := c.sh
+	if len(c.args) == 0 {
+		return ErrMissingArgument
+	}
+	if c.args[0] == "-a" {
+		sh.aliases = make(map[string]string)
+		return nil
+	}
+	var err error
+	for _, name := range c.args {
+		if _, ok := sh.aliases[name]; !ok {
+			err = fmt.Errorf("%s: not found", name)
+			fmt.Fprintf(c.stdErr, "unalias: %v\n", err)
+			continue
+		}
+		delete(sh.aliases, name)
+	}
+	if err != nil {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// typeCmd сообщает, как оболочка интерпретирует каждое из имён.
+func typeCmd(c cmdContext) error {
+	return c.sh.describe(c, func(name, kind, value string) string {
+		switch kind {
+		case "alias":
+			return fmt.Sprintf("%s is aliased to `%s'", name, value)
+		case "keyword":
+			return name + " is a shell keyword"
+		case "function":
+			return name + " is a function"
+		case "builtin":
+			return name + " is a shell builtin"
+		}
+		return fmt.Sprintf("%s is %s", name, value)
+	})
+}
+
+// which выводит путь к программе, которая будет запущена по имени.
+func which(c cmdContext) error {
+	return c.sh.describe(c, func(name, kind, value string) string {
+		switch kind {
+		case "alias":
+			return fmt.Sprintf("%s: aliased to %s", name, value)
+		case "keyword":
+			return name + ": shell reserved word"
+		case "function":
+			return name + ": shell function"
+		case "builtin":
+			return name + ": shell built-in command"
+		}
+		return value
+	})
+}
+
+// describe находит, чем является каждое из имён c.args - псевдонимом, ключевым словом,
+// функцией, встроенной командой или программой (kind == "file", value - путь), -
+// и выводит строку, сформированную format. Если имя не найдено, код завершения - 1.
+func (sh *shell) describe(c cmdContext, format func(name, kind, value string) string) error {
+	if len(c.args) == 0 {
+		return ErrMissingArgument
+	}
+	found := true
+	for _, name := range c.args {
+		kind, value := "", ""
+		if a, ok := sh.aliases[name]; ok {
+			kind, value = "alias", a
+		} else if listTerminators[name] || name == "if" || name == "for" || name == "while" ||
+			name == "until" || name == "function" || name == "in" || name == "{" || name == "!" {
+			kind = "keyword"
+		} else if _, ok := sh.funcs[name]; ok {
+			kind = "function"
+		} else if _, ok := sh.builtin(name); ok {
+			kind = "builtin"
+		} else if p, err := sh.lookPath(name); err == nil {
+			kind, value = "file", p
+		}
+		if kind == "" {
+			fmt.Fprintf(c.stdErr, "%s: not found\n", name)
+			found = false
+			continue
+		}
+		fmt.Fprintln(c.stdOut, format(name, kind, value))
+	}
+	if !found {
+		return &statusError{statusFailure}
+	}
+	return nil
+}
+
+// source выполняет команды из файла в текущей оболочке. Дополнительные аргументы
+// становятся позиционными параметрами на время выполнения.
+func source(c cmdContext) error {
+	sh := c.sh
+	if len(c.args) == 0 {
+		return ErrMissingArgument
+	}
+	file := c.args[0]
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(sh.dir, file)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	l, err := parseCmdLine(string(b))
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.args[0], err)
+	}
+	if len(c.args) > 1 {
+		saved := sh.args
+		sh.args = c.args[1:]
+		defer func() { sh.args = saved }()
+	}
+	status, err := sh.runList(l, c.std)
+	// return в файле завершает только его выполнение
+	var rc *returnControl
+	if errors.As(err, &rc) {
+		return exitWith(rc.status)
+	}
+	if err != nil {
+		return err
+	}
+	return exitWith(status)
+}
+
+// history выводит историю команд с номерами, history -c очищает её.
+func history(c cmdContext) error {
+	e := c.sh.editor
+	if e == nil {
+		return nil
+	}
+	if len(c.args) > 0 && c.args[0] == "-c" {
+		return e.hist.clear()
+	}
+	first := 0
+	if len(c.args) > 0 {
+		n, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			return fmt.Errorf("%s: numeric argument required", c.args[0])
+		}
+		if n < len(e.hist.lines) {
+			first = len(e.hist.lines) - n
+		}
+	}
+	for i := first; i < len(e.hist.lines); i++ {
+		fmt.Fprintf(c.stdOut, "%5d  %s\n", i+1, e.hist.lines[i])
+	}
+	return nil
+}
+
+// sortedKeys возвращает ключи отображения в алфавитном порядке.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellQuote заключает значение в одинарные кавычки, если без них оно было бы
+// разобрано оболочкой иначе.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./:,+=@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Interpreter - встраиваемый интерпретатор gosh: выполняет сценарии без терминала,
+// с заданными потоками ввода-вывода, каталогом и окружением. Состояние оболочки
+// (переменные, функции, текущий каталог) сохраняется между вызовами Run.
+// Поля читаются при первом вызове Run; нулевое значение готово к использованию.
+type Interpreter struct {
+	// Stdin, Stdout и Stderr - потоки ввода-вывода сценария; nil означает /dev/null.
+	// Если Stdin - не *os.File, он читается в фоне только во время Run: после
+	// возврата Run новые вызовы Read не выполняются, а команды, продолжающие
+	// читать ввод (например, фоновые задания), получают EOF. Read, начатый до
+	// возврата Run, может завершиться позже; прочитанные им данные отбрасываются.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Dir - начальный каталог; по умолчанию - текущий каталог процесса
+	Dir string
+	// Env - переменные окружения в виде NAME=value; nil - окружение процесса
+	Env []string
+
+	sh       *shell
+	builtins map[string]cmdFunc
+}
+
+// Builtin - пользовательская встроенная команда. Возвращает код завершения;
+// если возвращена ошибка, она выводится в stderr, и код завершения становится равным 1.
+type Builtin func(call *Call) (int, error)
+
+// Call описывает вызов пользовательской встроенной команды.
+type Call struct {
+	// Ctx отменяется вместе с контекстом Run
+	Ctx context.Context
+	// Args - аргументы после раскрытия, без имени команды
+	Args   []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Dir - текущий каталог оболочки
+	Dir string
+	// Getenv возвращает значение переменной оболочки
+	Getenv func(name string) string
+}
+
+// Register добавляет встроенную команду. Она перекрывает одноимённые встроенные
+// команды gosh и программы, но не функции, определённые в сценарии.
+func (it *Interpreter) Register(name string, fn Builtin) {
+	if it.builtins == nil {
+		it.builtins = make(map[string]cmdFunc)
+	}
+	it.builtins[name] = func(c cmdContext) error {
+		status, err := fn(&Call{
+			Ctx:    c.sh.ctx,
+			Args:   c.args,
+			Stdin:  c.stdin,
+			Stdout: c.stdOut,
+			Stderr: c.stdErr,
+			Dir:    c.sh.dir,
+			Getenv: c.sh.lookupVar,
+		})
+		if err != nil {
+			return err
+		}
+		return exitWith(status)
+	}
+	if it.sh != nil {
+		it.sh.builtins[name] = it.builtins[name]
+	}
+}
+
+// init создаёт оболочку интерпретатора при первом вызове Run.
+func (it *Interpreter) init() error {
+	if it.sh != nil {
+		return nil
+	}
+	sh := newShell(false)
+	if it.Env != nil {
+		sh.vars, sh.exported = make(map[string]string), make(map[string]bool)
+		sh.importEnv(it.Env)
+	}
+	if it.Dir != "" {
+		dir, err := filepath.Abs(it.Dir)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", dir)
+		}
+		sh.dir = dir
+	}
+	sh.vars["PWD"], sh.exported["PWD"] = sh.dir, true
+	// у каждого задания своя группа процессов, чтобы при отмене убить и потомков
+	sh.ownGroups = true
+	for name, fn := range it.builtins {
+		sh.builtins[name] = fn
+	}
+	it.sh = sh
+	return nil
+}
+
+// Run выполняет сценарий и возвращает код завершения последней команды (или код,
+// переданный exit). Ошибка возвращается при синтаксической ошибке в сценарии
+// и при отмене ctx; в последнем случае все запущенные сценарием процессы убиваются.
+func (it *Interpreter) Run(ctx context.Context, script string) (int, error) {
+	if err := it.init(); err != nil {
+		return statusFailure, err
+	}
+	sh := it.sh
+	l, err := parseCmdLine(script)
+	if err != nil {
+		return statusSyntax, err
+	}
+	std, files, err := it.openStdio()
+	if err != nil {
+		return statusFailure, err
+	}
+	sh.ctx = ctx
+	sh.running.reset()
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			sh.running.killAll()
+		case <-stop:
+		}
+	}()
+	status, err := sh.runList(l, std)
+	sh.waitBuiltins()
+	close(stop)
+	sh.ctx = context.Background()
+	files.close()
+	sh.status = status
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return status, ctxErr
+	}
+	if isControlFlow(err) {
+		// exit, а также break/continue вне цикла и return вне функции
+		// просто завершают выполнение сценария
+		err = nil
+	}
+	return status, err
+}
+
+// stdioFiles - файлы и каналы, открытые интерпретатором на время Run.
+type stdioFiles struct {
+	// файлы, которые нужно закрыть по окончании
+	files []*os.File
+	// копирование вывода из каналов в Stdout и Stderr
+	copying sync.WaitGroup
+	// закрывается в close и останавливает чтение Stdin
+	done chan struct{}
+}
+
+// close закрывает файлы и дожидается, пока весь вывод будет скопирован.
+// Если фоновые задания ещё пишут в канал, копирование закончится вместе с ними.
+func (f *stdioFiles) close() {
+	close(f.done)
+	closeFiles(f.files)
+	f.copying.Wait()
+}
+
+// openStdio подготавливает файлы ввода-вывода для запуска процессов. Потоки,
+// которые и так являются файлами, передаются как есть; для остальных создаются
+// каналы, данные из которых копируются в фоне.
+func (it *Interpreter) openStdio() (stdio, *stdioFiles, error) {
+	f := &stdioFiles{done: make(chan struct{})}
+	var std stdio
+	var err error
+	if std.in, err = f.input(it.Stdin); err == nil {
+		if std.out, err = f.output(it.Stdout); err == nil {
+			std.err, err = f.output(it.Stderr)
+		}
+	}
+	if err != nil {
+		f.close()
+		return stdio{}, nil, err
+	}
+	return std, f, nil
+}
+
+// input возвращает файл для чтения из r.
+func (f *stdioFiles) input(r io.Reader) (*os.File, error) {
+	if file, ok := r.(*os.File); ok {
+		return file, nil
+	}
+	if r == nil {
+		file, err := os.Open(os.DevNull)
+		if err == nil {
+			f.files = append(f.files, file)
+		}
+		return file, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// pw тоже закрывается в close: иначе процессы, унаследовавшие pr,
+	// держали бы копирование, а с ним и чтение r, после окончания Run
+	f.files = append(f.files, pr, pw)
+	go func() {
+		defer pw.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			select {
+			case <-f.done:
+				return
+			default:
+			}
+			n, err := r.Read(buf)
+			select {
+			case <-f.done:
+				return
+			default:
+			}
+			if n > 0 {
+				if _, err := pw.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+// output возвращает файл для записи в w.
+func (f *stdioFiles) output(w io.Writer) (*os.File, error) {
+	if file, ok := w.(*os.File); ok {
+		return file, nil
+	}
+	if w == nil {
+		file, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			f.files = append(f.files, file)
+		}
+		return file, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	f.files = append(f.files, pw)
+	f.copying.Add(1)
+	go func() {
+		defer f.copying.Done()
+		io.Copy(w, pr)
+		pr.Close()
+	}()
+	return pw, nil
+}
+
+// runningSet - множество запущенных и ещё не завершившихся процессов. Общее для
+// оболочки и её копий, чтобы при отмене контекста можно было убить все процессы.
+type runningSet struct {
+	mu    sync.Mutex
+	procs map[*process]bool
+	// killed - процессы уже убиты; новые убиваются сразу после запуска
+	killed bool
+}
+
+func newRunningSet() *runningSet {
+	return &runningSet{procs: make(map[*process]bool)}
+}
+
+// add добавляет процесс; если set уже убит, процесс тоже убивается.
+func (s *runningSet) add(p *process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.procs[p] = true
+	if s.killed {
+		p.kill()
+	}
+}
+
+// remove удаляет завершившийся процесс.
+func (s *runningSet) remove(p *process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.procs, p)
+}
+
+// killAll убивает все процессы вместе с их группами.
+func (s *runningSet) killAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.killed = true
+	for p := range s.procs {
+		p.kill()
+	}
+}
+
+// reset разрешает запускать процессы после killAll.
+func (s *runningSet) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.killed = false
+}
+
+// kill убивает процесс; если он лидер группы процессов, то и всю группу.
+func (p *process) kill() {
+	if p.pgid != 0 {
+		syscall.Kill(-p.pgid, syscall.SIGKILL)
+	}
+	syscall.Kill(p.pid, syscall.SIGKILL)
+}
+
+// parser обрабатывает строку, введенную пользователем, или текст сценария.
+// Возвращает ErrExit, если была выполнена команда exit, и синтаксические ошибки.
+func (sh *shell) parser(c string) error {
+	l, err := parseCmdLine(c)
+	if err != nil {
+		sh.status = statusSyntax
+		return err
+	}
+	sh.status, err = sh.runList(l, stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr})
+	if isControlFlow(err) && !errors.Is(err, ErrExit) {
+		// break/continue вне цикла и return вне функции просто прекращают выполнение
+		return nil
+	}
+	return err
+}
+
+// runScript выполняет сценарий: строку команд (gosh -c) или файл (gosh script.sh).
+// args[0] становится параметром $0, остальные - позиционными параметрами.
+// Возвращает код завершения для ОС.
+func runScript(command string, args []string) int {
+	sh := newShell(false)
+	sh.catchSignals()
+	src := command
+	if command == "" {
+		b, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			return statusNotFound
+		}
+		src = string(b)
+	}
+	if len(args) > 0 {
+		sh.name, sh.args = args[0], args[1:]
+	}
+	if err := sh.parser(src); err != nil && !errors.Is(err, ErrExit) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", sh.name, err)
+		return statusSyntax
+	}
+	sh.waitBuiltins()
+	// сигнал, пришедший во время последней команды, тоже должен быть обработан
+	std := stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr}
+	sh.handleSignals(std)
+	sh.runExitTrap(std)
+	return sh.status
+}
+
+// lineReader читает очередную строку ввода, предварительно выводя приглашение.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// scanReader читает строки из неинтерактивного ввода.
+type scanReader struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (r scanReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.scanner.Text(), nil
+}
+
+// hangupReader читает из r, пока не закрыт канал hup; после этого Read сразу
+// возвращает errHangup, не дожидаясь ввода. Незавершённое чтение из r остаётся
+// висеть, но после SIGHUP оболочка всё равно завершается.
+type hangupReader struct {
+	r   io.Reader
+	hup <-chan struct{}
+}
+
+// errHangup возвращается при чтении команды, прерванном SIGHUP.
+var errHangup = errors.New("hangup")
+
+func (h hangupReader) Read(p []byte) (int, error) {
+	select {
+	case <-h.hup:
+		return 0, errHangup
+	default:
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	// чтение идёт в свой буфер: после SIGHUP p уже не принадлежит этому вызову
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := h.r.Read(buf)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return copy(p, buf[:r.n]), r.err
+	case <-h.hup:
+		return 0, errHangup
+	}
+}
+
+// errCancelled возвращается редактором строки, если ввод отменён по Ctrl+C.
+var errCancelled = errors.New("cancelled")
+
+// максимальное число команд, хранимых в истории
+const historySize = 1000
+
+// lineEditor - редактор строки для терминала: курсор, история с поиском по Ctrl+R,
+// подстановки !! и !n, дополнение по Tab. На время чтения строки терминал
+// переводится в неканонический режим без эха.
+type lineEditor struct {
+	fd  int
+	in  *bufio.Reader
+	out io.Writer
+	// история команд
+	hist *cmdHistory
+	// complete возвращает дополняемое слово в конце head и варианты его замены
+	complete func(head string) (word string, candidates []string)
+
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+// newLineEditor создаёт редактор для терминала fd, читающий ввод из in, и загружает
+// историю из histFile. in читает тот же терминал - через os.Stdin, а не через второй
+// *os.File для того же дескриптора, который закрыл бы его при сборке мусора.
+func newLineEditor(fd int, in io.Reader, histFile string, complete func(string) (string, []string)) *lineEditor {
+	return &lineEditor{
+		fd:       fd,
+		in:       bufio.NewReader(in),
+		out:      os.Stdout,
+		hist:     loadHistory(histFile),
+		complete: complete,
+	}
+}
+
+// cmdHistory - история команд: последние historySize строк, которые также
+// дописываются в файл и загружаются из него при следующем запуске.
+type cmdHistory struct {
+	lines []string
+	// файл истории; пустая строка - история не сохраняется
+	file string
+}
+
+// loadHistory загружает историю из файла. Если в файле накопилось больше historySize
+// строк, он переписывается, чтобы не расти без конца.
+func loadHistory(file string) *cmdHistory {
+	h := &cmdHistory{file: file}
+	if file == "" {
+		return h
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > historySize {
+		h.lines = h.lines[len(h.lines)-historySize:]
+		os.WriteFile(file, []byte(strings.Join(h.lines, "\n")+"\n"), 0600)
+	}
+	return h
+}
+
+// add добавляет строку в историю и дописывает её в файл истории.
+// Пустые строки и повтор предыдущей команды не сохраняются.
+func (h *cmdHistory) add(line string) {
+	if strings.TrimSpace(line) == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > historySize {
+		h.lines = h.lines[1:]
+	}
+	if h.file == "" {
+		return
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// clear очищает историю вместе с файлом.
+func (h *cmdHistory) clear() error {
+	h.lines = nil
+	if h.file == "" {
+		return nil
+	}
+	return os.Truncate(h.file, 0)
+}
+
+// expand выполняет подстановки из истории: !! - предыдущая команда,
+// !n - команда с номером n, !-n - n-я с конца. Внутри одинарных кавычек
+// и после "\" восклицательный знак не раскрывается.
+func (h *cmdHistory) expand(line string) (string, bool, error) {
+	var sb strings.Builder
+	changed, inQuotes := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'':
+			inQuotes = !inQuotes
+		case c == '\\' && !inQuotes && i+1 < len(line):
+			sb.WriteByte(c)
+			i++
+			c = line[i]
+		case c == '!' && !inQuotes && i+1 < len(line):
+			event, n := h.event(line[i+1:])
+			if n == 0 {
+				break
+			}
+			if event == "" {
+				return "", false, fmt.Errorf("%s: event not found", line[i:i+1+n])
+			}
+			sb.WriteString(event)
+			changed = true
+			i += n
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), changed, nil
+}
+
+// event разбирает ссылку на историю после "!". Возвращает найденную команду
+// (пустую, если её нет) и длину ссылки; n == 0 - это не ссылка на историю.
+func (h *cmdHistory) event(s string) (event string, n int) {
+	if s[0] == '!' {
+		if len(h.lines) == 0 {
+			return "", 1
+		}
+		return h.lines[len(h.lines)-1], 1
+	}
+	for n < len(s) && (s[n] >= '0' && s[n] <= '9' || (n == 0 && s[n] == '-')) {
+		n++
+	}
+	num, err := strconv.Atoi(s[:n])
+	if err != nil {
+		return "", 0
+	}
+	if num < 0 {
+		num += len(h.lines) + 1
+	}
+	if num < 1 || num > len(h.lines) {
+		return "", n
+	}
+	return h.lines[num-1], n
+}
+
+// readLine читает строку с редактированием. Ctrl+D на пустой строке возвращает io.EOF,
+// Ctrl+C - errCancelled.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	orig, err := getTermios(e.fd)
+	if err != nil {
+		return "", err
+	}
+	raw := *orig
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON | syscall.BRKINT | syscall.INPCK | syscall.ISTRIP
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := setTermios(e.fd, &raw); err != nil {
+		return "", err
+	}
+	defer setTermios(e.fd, orig)
+
+	fmt.Fprint(e.out, prompt)
+	// при перерисовке выводится только последняя строка приглашения
+	e.prompt = prompt[strings.LastIndexByte(prompt, '\n')+1:]
+	e.buf, e.pos = e.buf[:0], 0
+	line, err := e.edit()
+	if err != nil {
+		return "", err
+	}
+	expanded, changed, err := e.hist.expand(line)
+	if err != nil {
+		fmt.Fprintf(e.out, "gosh: %v\r\n", err)
+		return "", errCancelled
+	}
+	if changed {
+		fmt.Fprintf(e.out, "%s\r\n", expanded)
+	}
+	e.hist.add(expanded)
+	return expanded, nil
+}
+
+// edit обрабатывает нажатия клавиш до Enter.
+func (e *lineEditor) edit() (string, error) {
+	// histPos - позиция в истории; saved - введённая строка, пока листаем историю
+	histPos, saved := len(e.hist.lines), ""
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.buf), nil
+		case 1: // Ctrl+A
+			e.pos = 0
+		case 2: // Ctrl+B
+			e.move(-1)
+		case 3: // Ctrl+C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errCancelled
+		case 4: // Ctrl+D
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case 5: // Ctrl+E
+			e.pos = len(e.buf)
+		case 6: // Ctrl+F
+			e.move(1)
+		case 8, 127: // Backspace
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case '\t':
+			e.completeWord()
+		case 11: // Ctrl+K
+			e.buf = e.buf[:e.pos]
+		case 12: // Ctrl+L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J"+e.prompt)
+		case 14: // Ctrl+N
+			histPos, saved = e.browse(histPos, 1, saved)
+		case 16: // Ctrl+P
+			histPos, saved = e.browse(histPos, -1, saved)
+		case 18: // Ctrl+R
+			if line, accepted := e.search(); accepted {
+				return line, nil
+			}
+		case 21: // Ctrl+U
+			e.buf = append(e.buf[:0], e.buf[e.pos:]...)
+			e.pos = 0
+		case 23: // Ctrl+W
+			start := e.pos
+			for start > 0 && e.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && e.buf[start-1] != ' ' {
+				start--
+			}
+			e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+			e.pos = start
+		case 27: // Esc-последовательности: стрелки, Home, End, Delete
+			switch e.escape() {
+			case "A":
+				histPos, saved = e.browse(histPos, -1, saved)
+			case "B":
+				histPos, saved = e.browse(histPos, 1, saved)
+			case "C":
+				e.move(1)
+			case "D":
+				e.move(-1)
+			case "H", "1~", "7~":
+				e.pos = 0
+			case "F", "4~", "8~":
+				e.pos = len(e.buf)
+			case "3~":
+				e.deleteAt(e.pos)
+			}
+		default:
+			if r >= ' ' {
+				e.insert(string(r))
+			}
+		}
+		e.refresh()
+	}
+}
+
+// escape читает остаток Esc-последовательности и возвращает её без префикса "ESC [".
+func (e *lineEditor) escape() string {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return ""
+	}
+	var seq []byte
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+// move сдвигает курсор на delta символов в пределах строки.
+func (e *lineEditor) move(delta int) {
+	e.pos += delta
+	if e.pos < 0 {
+		e.pos = 0
+	}
+	if e.pos > len(e.buf) {
+		e.pos = len(e.buf)
+	}
+}
+
+// insert вставляет текст в позицию курсора.
+func (e *lineEditor) insert(s string) {
+	rs := []rune(s)
+	e.buf = append(e.buf[:e.pos], append(rs, e.buf[e.pos:]...)...)
+	e.pos += len(rs)
+}
+
+// deleteAt удаляет символ в позиции i.
+func (e *lineEditor) deleteAt(i int) {
+	if i < len(e.buf) {
+		e.buf = append(e.buf[:i], e.buf[i+1:]...)
+	}
+}
+
+// setLine заменяет содержимое строки и ставит курсор в конец.
+func (e *lineEditor) setLine(s string) {
+	e.buf = []rune(s)
+	e.pos = len(e.buf)
+}
+
+// browse перемещается по истории на delta позиций. Строка, которую пользователь
+// набирал до начала листания, сохраняется в saved и восстанавливается в конце истории.
+func (e *lineEditor) browse(histPos, delta int, saved string) (int, string) {
+	next := histPos + delta
+	if next < 0 || next > len(e.hist.lines) {
+		return histPos, saved
+	}
+	if histPos == len(e.hist.lines) {
+		saved = string(e.buf)
+	}
+	if next == len(e.hist.lines) {
+		e.setLine(saved)
+	} else {
+		e.setLine(e.hist.lines[next])
+	}
+	return next, saved
+}
+
+// refresh перерисовывает строку: приглашение, текст и курсор.
+func (e *lineEditor) refresh() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K\r%s%s", e.prompt, string(e.buf), e.prompt, string(e.buf[:e.pos]))
+}
+
+// search - поиск по истории в обратном направлении (Ctrl+R). Enter выполняет
+// найденную команду (accepted == true), Ctrl+G и Ctrl+C отменяют поиск,
+// остальные клавиши оставляют найденную команду в строке для редактирования.
+func (e *lineEditor) search() (line string, accepted bool) {
+	var query []rune
+	match, idx := "", len(e.hist.lines)
+	find := func(from int) {
+		if from >= len(e.hist.lines) {
+			from = len(e.hist.lines) - 1
+		}
+		for i := from; i >= 0; i-- {
+			if strings.Contains(e.hist.lines[i], string(query)) {
+				match, idx = e.hist.lines[i], i
+				return
+			}
+		}
+	}
+	for {
+		fmt.Fprintf(e.out, "\r(reverse-i-search)`%s': %s\x1b[K", string(query), match)
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case r == 18: // Ctrl+R - следующее совпадение
+			find(idx - 1)
+		case r == 8 || r == 127:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				find(len(e.hist.lines) - 1)
+			}
+		case r == 3 || r == 7: // Ctrl+C, Ctrl+G
+			return "", false
+		case r == '\r' || r == '\n':
+			e.setLine(match)
+			e.refresh()
+			fmt.Fprint(e.out, "\r\n")
+			return match, true
+		case r >= ' ':
+			query = append(query, r)
+			find(idx)
+		default:
+			if r == 27 {
+				e.escape()
+			}
+			e.setLine(match)
+			return "", false
+		}
+	}
+}
+
+// completeWord дополняет слово перед курсором (см. completion).
+func (e *lineEditor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	word, candidates := e.complete(string(e.buf[:e.pos]))
+	replacement, list := completion(word, candidates)
+	if replacement != "" {
+		start := e.pos - len([]rune(word))
+		e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+		e.pos = start
+		e.insert(replacement)
+	}
+	if list != nil {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(list, "  "))
+	}
+}
+
+// completion решает, как дополнить слово word вариантами candidates. Если вариант
+// один, он подставляется целиком (с пробелом после имени файла или команды); если
+// несколько - подставляется их общий префикс, а когда дополнять нечего, возвращается
+// список вариантов для вывода: только последние компоненты путей.
+func completion(word string, candidates []string) (replacement string, list []string) {
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	if len(candidates) == 1 {
+		c := candidates[0]
+		if !strings.HasSuffix(c, "/") {
+			c += " "
+		}
+		return c, nil
+	}
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		return prefix, nil
+	}
+	list = make([]string, len(candidates))
+	for i, c := range candidates {
+		list[i] = path.Base(c)
+		if strings.HasSuffix(c, "/") {
+			list[i] += "/"
+		}
+	}
+	return "", list
+}
+
+// complete ищет варианты дополнения для последнего слова строки head: в позиции
+// команды - встроенные команды, функции и программы из $PATH, иначе - пути к файлам.
+func (sh *shell) complete(head string) (string, []string) {
+	// начало слова - после последнего неэкранированного пробела или оператора
+	start := 0
+	for i := 0; i < len(head); i++ {
+		switch c := head[i]; {
+		case c == '\\':
+			i++
+		case c == ' ' || c == '\t' || strings.IndexByte(";|&(){}", c) >= 0:
+			start = i + 1
+		}
+	}
+	if start > len(head) {
+		start = len(head)
+	}
+	word := head[start:]
+	prefix := unescape(word)
+	var candidates []string
+	if isCommandPosition(head[:start]) && !strings.Contains(prefix, "/") {
+		candidates = sh.completeCommand(prefix)
+	} else {
+		candidates = sh.completePath(prefix)
+	}
+	for i, c := range candidates {
+		candidates[i] = escape(c)
+	}
+	return word, candidates
+}
+
+// isCommandPosition сообщает, стоит ли слово после текста before на месте имени команды.
+func isCommandPosition(before string) bool {
+	before = strings.TrimRight(before, " \t")
+	if before == "" || strings.IndexByte(";|&({", before[len(before)-1]) >= 0 {
+		return true
+	}
+	fields := strings.Fields(before)
+	switch fields[len(fields)-1] {
+	case "then", "do", "else", "elif", "if", "while", "until", "!":
+		return true
+	}
+	return false
+}
+
+// completeCommand возвращает имена команд, начинающиеся с prefix.
+func (sh *shell) completeCommand(prefix string) []string {
+	seen := make(map[string]bool)
+	for name := range cmdMap {
+		if strings.HasPrefix(name, prefix) {
+			seen[name] = true
+		}
+	}
+	for name := range sh.funcs {
+		if strings.HasPrefix(name, prefix) {
+			seen[name] = true
+		}
+	}
+	for name := range sh.builtins {
+		if strings.HasPrefix(name, prefix) {
+			seen[name] = true
+		}
+	}
+	for name := range sh.aliases {
+		if strings.HasPrefix(name, prefix) {
+			seen[name] = true
+		}
+	}
+	for _, dir := range filepath.SplitList(sh.vars["PATH"]) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), prefix) || seen[entry.Name()] {
+				continue
+			}
+			if checkExecutable(filepath.Join(dir, entry.Name())) == nil {
+				seen[entry.Name()] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completePath возвращает пути, начинающиеся с prefix; каталоги - с "/" в конце.
+// Относительные пути отсчитываются от текущего каталога оболочки.
+func (sh *shell) completePath(prefix string) []string {
+	dir, base := path.Split(prefix)
+	searchDir := dir
+	if !filepath.IsAbs(dir) {
+		searchDir = filepath.Join(sh.dir, dir)
+	}
+	entries, err := os.ReadDir(searchDir)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// скрытые файлы показываем, только если их явно запросили
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		p := dir + name
+		if fi, err := os.Stat(filepath.Join(searchDir, name)); err == nil && fi.IsDir() {
+			p += "/"
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// escape экранирует в имени символы, которые иначе были бы восприняты оболочкой.
+func escape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(" \t'\"\\$&|;()<>{}*?[]#!", s[i]) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// unescape убирает экранирующие "\".
+func unescape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// getTermios возвращает настройки терминала.
+func getTermios(fd int) (*syscall.Termios, error) {
+	var t syscall.Termios
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if e != 0 {
+		return nil, e
+	}
+	return &t, nil
+}
+
+// setTermios применяет настройки терминала.
+func setTermios(fd int, t *syscall.Termios) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(t)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// isTerminal сообщает, связан ли файловый дескриптор с терминалом.
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// tcgetpgrp возвращает группу процессов, которой принадлежит терминал.
+func tcgetpgrp(fd int) (int, error) {
+	var pgid int32
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(pgid), nil
+}
+
+// tcsetpgrp передаёт терминал группе процессов pgid. На время вызова поток
+// блокирует SIGTTOU - иначе оболочка, оказавшаяся в фоне, была бы остановлена.
+func tcsetpgrp(fd, pgid int) error {
+	const (
+		sigBlock   = 0
+		sigSetMask = 2
+	)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	set := uint64(1) << (uint(syscall.SIGTTOU) - 1)
+	var old uint64
+	_, _, e := syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, sigBlock,
+		uintptr(unsafe.Pointer(&set)), uintptr(unsafe.Pointer(&old)), unsafe.Sizeof(set), 0, 0)
+	if e != 0 {
+		return e
+	}
+	defer syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, sigSetMask,
+		uintptr(unsafe.Pointer(&old)), 0, unsafe.Sizeof(old), 0, 0)
+	p := int32(pgid)
+	_, _, e = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&p)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func main() {
+	command := flag.String("c", "", "execute commands from the string")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: gosh [-c command | script] [args...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *command != "" || flag.NArg() > 0 {
+		os.Exit(runScript(*command, flag.Args()))
+	}
+
+	sh := newShell(true)
+	std := stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr}
+	sh.catchSignals()
+	// на терминале строки читает редактор, иначе - обычный сканер
+	stdin := hangupReader{r: os.Stdin, hup: sh.signals.hangup()}
+	var in lineReader = scanReader{scanner: bufio.NewScanner(stdin), out: os.Stdout}
+	if sh.jobControl {
+		histFile := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			histFile = filepath.Join(home, ".gosh_history")
+		}
+		sh.editor = newLineEditor(sh.ttyFd, stdin, histFile, sh.complete)
+		in = sh.editor
+	}
+	fmt.Println("Welcome to gosh!")
+	// src накапливает строки, пока введённая конструкция не будет завершена
+	var src string
+	for {
+		// Ctrl+C у приглашения только сбрасывает ввод
+		if err := sh.handleSignals(std); errors.Is(err, ErrExit) {
+			break
+		}
+		sh.reportJobs(os.Stdout)
+		prompt := sh.prompt()
+		if src != "" {
+			prompt = "> "
+			if ps2, ok := sh.vars["PS2"]; ok {
+				prompt = sh.expandPrompt(ps2)
+			}
+		}
+		line, err := in.readLine(prompt)
+		if errors.Is(err, errHangup) {
+			// терминал закрыт, пока оболочка ждала ввода: SIGHUP уже в очереди,
+			// и оболочку завершит handleSignals
+			continue
+		}
+		if errors.Is(err, errCancelled) {
+			src = ""
+			sh.status = statusSignal + int(syscall.SIGINT)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		src += line + "\n"
+		err = sh.parser(src)
+		if errors.Is(err, ErrIncomplete) {
+			continue
+		}
+		src = ""
+		if errors.Is(err, ErrExit) {
+			// первая попытка выйти при остановленных заданиях только предупреждает о них
+			if sh.stoppedWarned || sh.status == statusSignal+int(syscall.SIGHUP) || !sh.hasStoppedJobs() {
+				break
+			}
+			fmt.Fprintln(os.Stderr, "There are stopped jobs.")
+			sh.stoppedWarned = true
+			continue
+		}
+		sh.stoppedWarned = false
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	sh.exit(std)
+}
+
+// exit завершает интерактивную оболочку: выполняет обработчик EXIT, посылает
+// SIGHUP оставшимся заданиям и возвращает терминал.
+func (sh *shell) exit(std stdio) {
+	sh.runExitTrap(std)
+	sh.hangupJobs()
 	fmt.Println("Bye!")
+	sh.close()
+	os.Exit(sh.status)
 }
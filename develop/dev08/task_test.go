@@ -1 +1,1173 @@
 package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// сценарные тесты запускают сам тестовый бинарник в роли gosh
+	if os.Getenv("GOSH_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runShell выполняет сценарий в оболочке sh и возвращает код завершения и вывод.
+func runShell(t *testing.T, sh *shell, script string) (int, string, string) {
+	t.Helper()
+	l, err := parseCmdLine(script)
+	if err != nil {
+		t.Fatalf("parseCmdLine(%q): %v", script, err)
+	}
+	dir := t.TempDir()
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	// exit просто завершает сценарий
+	status, _ := sh.runList(l, stdio{in: stdin, out: stdout, err: stderr})
+	out, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errOut, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(out), string(errOut)
+}
+
+// run выполняет сценарий в новом интерпретаторе и возвращает код завершения и вывод.
+func run(t *testing.T, it *Interpreter, script string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr strings.Builder
+	it.Stdout, it.Stderr = &stdout, &stderr
+	status, err := it.Run(context.Background(), script)
+	if err != nil {
+		t.Fatalf("Run(%q): %v", script, err)
+	}
+	return status, stdout.String(), stderr.String()
+}
+
+func TestInterpreterRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		status int
+		out    string
+	}{
+		{"Builtin", "echo hello world", 0, "hello world\n"},
+		{"External", "printf '%s-%s\\n' a b", 0, "a-b\n"},
+		{"Pipeline", "echo one two | tr a-z A-Z", 0, "ONE TWO\n"},
+		{"Variables", "x=42; echo $x; sh -c 'echo [$x]'; export x; sh -c 'echo [$x]'", 0, "42\n[]\n[42]\n"},
+		{"AndOr", "false && echo no || echo yes", 0, "yes\n"},
+		{"Status", "echo out; false", 1, "out\n"},
+		{"NotFound", "no-such-command-gosh", statusNotFound, ""},
+		{"Loop", "for i in 1 2 3; do echo $i; done", 0, "1\n2\n3\n"},
+		{"Exit", "echo before; exit; echo after", 0, "before\n"},
+		{"ExitCode", "exit 7", 7, ""},
+		{"ExitLastStatus", "false; exit", 1, ""},
+		{"ExitBadArgument", "exit abc", statusSyntax, ""},
+		{"StatusVar", "false; echo $?; echo $?", 0, "1\n0\n"},
+		{"StatusNotFound", "no-such-command-gosh; echo $?", 0, "127\n"},
+		{"StatusSubshell", "(exit 3); echo $? \"$?\"", 0, "3 3\n"},
+		{"StatusBuiltinError", "cd /no/such/dir; echo $?", 0, "1\n"},
+		{"StatusNegated", "! true; echo $?", 0, "1\n"},
+		{"WaitStatus", "sh -c 'exit 5' & wait %1; echo $?", 0, "5\n"},
+		{"WaitAll", "sh -c 'exit 5' & wait; echo $?", 0, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, out, _ := run(t, &Interpreter{}, tt.script)
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if out != tt.out {
+				t.Errorf("stdout = %q, want %q", out, tt.out)
+			}
+		})
+	}
+}
+
+func TestInterpreterSyntaxError(t *testing.T) {
+	status, err := (&Interpreter{}).Run(context.Background(), "echo a && && echo b")
+	if err == nil || status != statusSyntax {
+		t.Errorf("Run() = %d, %v; want syntax error", status, err)
+	}
+}
+
+func TestInterpreterState(t *testing.T) {
+	it := &Interpreter{}
+	run(t, it, "greet() { echo hi $1; }; name=gosh")
+	if _, out, _ := run(t, it, "greet $name"); out != "hi gosh\n" {
+		t.Errorf("stdout = %q, want %q", out, "hi gosh\n")
+	}
+}
+
+func TestInterpreterDirEnv(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	it := &Interpreter{
+		Dir: dir,
+		Env: []string{"PATH=" + os.Getenv("PATH"), "GREETING=hello"},
+	}
+	_, out, _ := run(t, it, "cat file.txt; pwd; sh -c 'echo $GREETING'; env | grep -c =")
+	want := "data\n" + dir + "\nhello\n3\n"
+	if out != want {
+		t.Errorf("stdout = %q, want %q", out, want)
+	}
+}
+
+func TestInterpreterStdin(t *testing.T) {
+	it := &Interpreter{Stdin: strings.NewReader("b\na\nc\n")}
+	if _, out, _ := run(t, it, "sort"); out != "a\nb\nc\n" {
+		t.Errorf("stdout = %q", out)
+	}
+}
+
+// slowReader бесконечно отдаёт по одному байту с задержкой и считает вызовы Read.
+type slowReader struct {
+	mu    sync.Mutex
+	reads int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	r.reads++
+	r.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	p[0] = 'y'
+	return 1, nil
+}
+
+func (r *slowReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads
+}
+
+func TestInterpreterStdinStop(t *testing.T) {
+	// фоновый процесс наследует канал ввода, но после Run ввод читаться не должен
+	// Stdout и Stderr не заданы, чтобы Run не ждал копирования вывода задания
+	r := &slowReader{}
+	if status, err := (&Interpreter{Stdin: r}).Run(context.Background(), "sleep 1 &"); status != 0 || err != nil {
+		t.Fatalf("Run = %d, %v", status, err)
+	}
+	n := r.count()
+	time.Sleep(100 * time.Millisecond)
+	// Read, начатый до возврата Run, может успеть завершиться
+	if m := r.count(); m > n+1 {
+		t.Errorf("Stdin was read %d times after Run returned", m-n)
+	}
+}
+
+func TestInterpreterRegister(t *testing.T) {
+	it := &Interpreter{}
+	it.Register("sum", func(c *Call) (int, error) {
+		total := 0
+		for _, arg := range c.Args {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+		fmt.Fprintln(c.Stdout, total)
+		return total % 2, nil
+	})
+	status, out, _ := run(t, it, "sum 1 2 4; sum 1 2 | tr 3 x")
+	if out != "7\nx\n" || status != 0 {
+		t.Errorf("Run() = %d, %q", status, out)
+	}
+	status, _, _ = run(t, it, "sum 1 2 4")
+	if status != 1 {
+		t.Errorf("status = %d, want 1", status)
+	}
+	status, _, errOut := run(t, it, "sum x")
+	if status != statusFailure || !strings.Contains(errOut, "sum:") {
+		t.Errorf("Run() = %d, stderr %q", status, errOut)
+	}
+}
+
+func TestInterpreterCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var out strings.Builder
+	it := &Interpreter{Stdout: &out}
+	start := time.Now()
+	// sh порождает собственного потомка: убита должна быть вся группа
+	_, err := it.Run(ctx, "echo started; sh -c 'sleep 10; echo inner'; echo after")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run returned after %v", elapsed)
+	}
+	if out.String() != "started\n" {
+		t.Errorf("stdout = %q", out.String())
+	}
+}
+
+func TestInterpreterCancelLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	it := &Interpreter{}
+	it.Register("stop", func(*Call) (int, error) {
+		cancel()
+		return 0, nil
+	})
+	_, err := it.Run(ctx, "while true; do stop; done")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+// freePort возвращает номер свободного порта TCP на localhost.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestNcClientHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		// отвечаем, только дочитав запрос до конца: без half-close клиент бы завис
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+		fmt.Fprint(conn, "pong\n")
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	status, out, errOut := run(t, &Interpreter{}, "echo ping | nc 127.0.0.1 "+port)
+	if status != 0 || out != "pong\n" {
+		t.Errorf("Run() = %d, %q, stderr %q", status, out, errOut)
+	}
+	if got := <-received; got != "ping\n" {
+		t.Errorf("server received %q", got)
+	}
+}
+
+func TestNcUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	status, out, errOut := run(t, &Interpreter{}, "echo hello | nc -u -w 0.5 127.0.0.1 "+port)
+	if status != 0 || out != "HELLO\n" {
+		t.Errorf("Run() = %d, %q, stderr %q", status, out, errOut)
+	}
+}
+
+func TestNcListen(t *testing.T) {
+	port := freePort(t)
+	var out strings.Builder
+	it := &Interpreter{Stdin: strings.NewReader("from nc\n"), Stdout: &out}
+	result := make(chan error, 1)
+	go func() {
+		_, err := it.Run(context.Background(), "nc -l 127.0.0.1 "+port)
+		result <- err
+	}()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "hello\n")
+	conn.(*net.TCPConn).CloseWrite()
+	data, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(data) != "from nc\n" {
+		t.Errorf("client received %q", data)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("stdout = %q", out.String())
+	}
+}
+
+func TestNcIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// соединение принимается, но сервер молчит и не закрывает его
+		if conn, err := ln.Accept(); err == nil {
+			time.Sleep(5 * time.Second)
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	start := time.Now()
+	run(t, &Interpreter{}, "nc -w 0.3 127.0.0.1 "+port)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("nc returned after %v", elapsed)
+	}
+}
+
+func TestNcScan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, open, _ := net.SplitHostPort(ln.Addr().String())
+	closed := freePort(t)
+
+	status, _, errOut := run(t, &Interpreter{}, "nc -z -v -w 1 127.0.0.1 "+open+" "+closed)
+	if status != 0 {
+		t.Errorf("status = %d, want 0", status)
+	}
+	if !strings.Contains(errOut, "port "+open+" [tcp] succeeded") ||
+		!strings.Contains(errOut, "port "+closed+" (tcp) failed") {
+		t.Errorf("stderr = %q", errOut)
+	}
+	if status, _, _ := run(t, &Interpreter{}, "nc -z -w 1 127.0.0.1 "+closed+"-"+closed); status != statusFailure {
+		t.Errorf("status = %d, want %d", status, statusFailure)
+	}
+	if status, _, _ := run(t, &Interpreter{}, "nc -z 127.0.0.1 10-1"); status != statusFailure {
+		t.Errorf("invalid range: status = %d, want %d", status, statusFailure)
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	home := t.TempDir()
+	repo := filepath.Join(home, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, ".git", "HEAD"), []byte("ref: refs/heads/feature/x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(repo, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newShell(false)
+	sh.vars["HOME"] = home
+	sh.vars["NAME"] = "gosh"
+	sh.status = 3
+	tests := []struct {
+		dir, ps1, want string
+	}{
+		{home, `\w$ `, "~$ "},
+		{sub, `\w \W> `, "~/repo/sub sub> "},
+		{"/", `[\W]`, "[/]"},
+		{sub, `(\g)`, "(feature/x)"},
+		{home, `(\g)`, "()"},
+		{home, `\? $? ${NAME}\\\n`, "3 3 gosh\\\n"},
+		{home, `\[\e[1m\]x\[\e[0m\]`, "\x1b[1mx\x1b[0m"},
+		{home, `\s \q`, `gosh \q`},
+	}
+	for _, tt := range tests {
+		sh.dir = tt.dir
+		sh.vars["PS1"] = tt.ps1
+		if got := sh.prompt(); got != tt.want {
+			t.Errorf("PS1=%q: prompt = %q, want %q", tt.ps1, got, tt.want)
+		}
+	}
+}
+
+func TestTrap(t *testing.T) {
+	it := &Interpreter{}
+	status, out, _ := run(t, it, "trap 'echo got it' INT USR1; trap '' 15; trap -- 'echo bye' EXIT; trap")
+	want := "trap -- 'echo bye' EXIT\ntrap -- 'echo got it' SIGINT\ntrap -- 'echo got it' SIGUSR1\ntrap -- '' SIGTERM\n"
+	if status != 0 || out != want {
+		t.Errorf("trap: status %d, stdout = %q, want %q", status, out, want)
+	}
+	if _, out, _ := run(t, it, "trap - INT; trap USR1; trap -p INT USR1 EXIT"); out != "trap -- 'echo bye' EXIT\n" {
+		t.Errorf("trap -p after reset: stdout = %q", out)
+	}
+	status, _, errOut := run(t, it, "trap 'echo x' KILL NOSUCH")
+	if status != statusFailure || !strings.Contains(errOut, "KILL: signal cannot be trapped") ||
+		!strings.Contains(errOut, "NOSUCH: invalid signal specification") {
+		t.Errorf("invalid signals: status %d, stderr = %q", status, errOut)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	it := &Interpreter{}
+	run(t, it, "trap 'echo trapped $?' USR1")
+	// сигналы, полученные оболочкой, обрабатываются перед следующей командой
+	it.sh.signals = newSigState(false)
+	it.sh.signals.raise(syscall.SIGUSR1)
+	status, out, _ := run(t, it, "false; echo after $?")
+	if status != 0 || out != "trapped 0\nafter 1\n" {
+		t.Errorf("trap handler: status %d, stdout = %q", status, out)
+	}
+
+	// без обработчика SIGTERM завершает неинтерактивную оболочку
+	it.sh.signals.raise(syscall.SIGTERM)
+	status, out, _ = run(t, it, "echo not reached")
+	if status != statusSignal+int(syscall.SIGTERM) || out != "" {
+		t.Errorf("SIGTERM: status %d, stdout = %q", status, out)
+	}
+}
+
+func TestHangupReader(t *testing.T) {
+	s := newSigState(true)
+	go s.dispatch()
+	defer close(s.ch)
+	r, w := io.Pipe()
+	defer w.Close()
+	in := hangupReader{r: r, hup: s.hangup()}
+	go w.Write([]byte("ls\n"))
+	buf := make([]byte, 16)
+	if n, err := in.Read(buf); err != nil || string(buf[:n]) != "ls\n" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	// SIGHUP прерывает ожидание ввода, а сам сигнал остаётся в очереди
+	// для основного потока
+	done := make(chan error, 1)
+	go func() {
+		_, err := in.Read(buf)
+		done <- err
+	}()
+	s.ch <- syscall.SIGHUP
+	select {
+	case err := <-done:
+		if err != errHangup {
+			t.Errorf("Read() after SIGHUP: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read() not interrupted by SIGHUP")
+	}
+	if sigs := s.take(); len(sigs) != 1 || sigs[0] != syscall.SIGHUP {
+		t.Errorf("pending signals = %v", sigs)
+	}
+	sh := newShell(true)
+	sh.signals = s
+	s.raise(syscall.SIGHUP)
+	if err := sh.handleSignals(stdio{}); err != ErrExit || sh.status != statusSignal+int(syscall.SIGHUP) {
+		t.Errorf("handleSignals() = %v, status %d", err, sh.status)
+	}
+}
+
+func TestCommandLists(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		script string
+		status int
+		out    string
+	}{
+		{"Sequence", "echo a; echo b", 0, "a\nb\n"},
+		{"And", "true && echo yes; false && echo no", 1, "yes\n"},
+		{"Or", "false || echo yes; true || echo no", 0, "yes\n"},
+		{"AndOrChain", "false && echo a || echo b && echo c", 0, "b\nc\n"},
+		{"Group", "{ echo a; echo b; } | tr a-z A-Z", 0, "A\nB\n"},
+		{"GroupStatus", "{ true; false; } || echo failed", 0, "failed\n"},
+		{"GroupSharesState", "{ cd /; }; pwd", 0, "/\n"},
+		{"GroupExit", "{ echo a; exit; }; echo not reached", 0, "a\n"},
+		{"GroupMultiline", "{\n echo a\n echo b\n}", 0, "a\nb\n"},
+		{"SubshellIsolated", "(cd /; pwd); pwd", 0, "/\n{dir}\n"},
+		{"SubshellExit", "(echo a; exit; echo b); echo c", 0, "a\nc\n"},
+		{"SubshellAndOr", "(false) && echo no || echo yes", 0, "yes\n"},
+		{"NestedSubshell", "( (false) || echo inner ) && echo outer", 0, "inner\nouter\n"},
+		{"NestedSubshellStatus", "( (false) ) || echo failed", 0, "failed\n"},
+		{"SubshellInGroup", "{ (false) || echo caught; }", 0, "caught\n"},
+		{"ListStatus", "true; (false)", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := newShell(false)
+			sh.dir = dir
+			status, out, _ := runShell(t, sh, tt.script)
+			want := strings.ReplaceAll(tt.out, "{dir}", dir)
+			if status != tt.status || out != want {
+				t.Errorf("runShell() = %d, %q; want %d, %q", status, out, tt.status, want)
+			}
+		})
+	}
+	for _, script := range []string{"{ echo a }", "(echo a", "echo a &&", "; echo a"} {
+		if _, err := parseCmdLine(script); err == nil {
+			t.Errorf("parseCmdLine(%q): no error", script)
+		}
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		status int
+		out    string
+	}{
+		{"If", "if true; then echo yes; fi", 0, "yes\n"},
+		{"IfFalse", "if false; then echo yes; fi", 0, ""},
+		{"Else", "if false; then echo a; else echo b; fi", 0, "b\n"},
+		{"Elif", "x=2; if [ $x = 1 ]; then echo one; elif [ $x = 2 ]; then echo two; else echo many; fi", 0, "two\n"},
+		{"ElifElse", "if false; then echo a; elif false; then echo b; else echo c; fi", 0, "c\n"},
+		{"IfConditionList", "if false; true; then echo yes; fi", 0, "yes\n"},
+		{"IfStatus", "if true; then false; fi", 1, ""},
+		{"IfMultiline", "if true\nthen\n  echo a\nelse\n  echo b\nfi", 0, "a\n"},
+		{"While", "i=; while [ \"$i\" != xxx ]; do i=${i}x; echo $i; done", 0, "x\nxx\nxxx\n"},
+		{"WhileBreak", "while true; do echo once; break; done", 0, "once\n"},
+		{"ForContinue", "for i in 1 2 3; do if [ $i = 2 ]; then continue; fi; echo $i; done", 0, "1\n3\n"},
+		{"NestedBreak", "for i in a b; do for j in 1 2; do echo $i$j; break 2; done; done", 0, "a1\n"},
+		{"Function", "greet() { echo hello $1; }; greet world", 0, "hello world\n"},
+		{"FunctionKeyword", "function greet { echo hi; }; greet", 0, "hi\n"},
+		{"FunctionArgs", "f() { echo $# \"$@\"; echo $2; }; f a 'b c' d", 0, "3 a b c d\nb c\n"},
+		{"FunctionNoArgs", "f() { echo [$#] [$@]; }; f", 0, "[0] []\n"},
+		{"FunctionReturn", "f() { return 3; echo no; }; f", 3, ""},
+		{"FunctionStatus", "f() { false; }; f", 1, ""},
+		{"FunctionRestoresArgs", "g() { echo $1; }; f() { g inner; echo $1; }; f outer", 0, "inner\nouter\n"},
+		{"FunctionPipeline", "f() { echo a; echo b; }; f | tr a-z A-Z", 0, "A\nB\n"},
+		{"Recursion", "count() { echo $1; if [ $1 != xxx ]; then count ${1}x; fi; }; count x", 0, "x\nxx\nxxx\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, out, _ := runShell(t, newShell(false), tt.script)
+			if status != tt.status || out != tt.out {
+				t.Errorf("runShell() = %d, %q; want %d, %q", status, out, tt.status, tt.out)
+			}
+		})
+	}
+	for _, script := range []string{"if true; then echo a", "while true; echo a; done", "f() { echo a"} {
+		if _, err := parseCmdLine(script); err == nil {
+			t.Errorf("parseCmdLine(%q): no error", script)
+		}
+	}
+}
+
+// gosh запускает тестовый бинарник как gosh (см. TestMain) и возвращает код
+// завершения и stdout.
+func gosh(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runGosh(t, exec.Command(self, args...))
+}
+
+func runGosh(t *testing.T, cmd *exec.Cmd) (int, string) {
+	t.Helper()
+	cmd.Env = append(os.Environ(), "GOSH_TEST_MAIN=1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("%v: %v", cmd.Args, err)
+	}
+	if stderr.Len() > 0 {
+		t.Logf("%v stderr: %s", cmd.Args, stderr.String())
+	}
+	return cmd.ProcessState.ExitCode(), string(out)
+}
+
+func TestScriptMode(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(script, []byte("echo $0 $#\nfor a in \"$@\"; do echo \"[$a]\"; done\necho bg &\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shebang := filepath.Join(dir, "shebang")
+	if err := os.WriteFile(shebang, []byte("#!"+self+"\n# комментарий\necho from $1\nfalse\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	noShebang := filepath.Join(dir, "plain")
+	if err := os.WriteFile(noShebang, []byte("echo plain $1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		out    string
+	}{
+		{"Command", []string{"-c", "echo $0 $# \"$@\"", "name", "a", "b c"}, 0, "name 2 a b c\n"},
+		{"CommandStatus", []string{"-c", "false"}, 1, ""},
+		{"CommandExit", []string{"-c", "false; exit; echo no"}, 1, ""},
+		{"CommandSyntax", []string{"-c", "echo (("}, statusSyntax, ""},
+		{"BackgroundBuiltin", []string{"-c", "echo hi &"}, 0, "hi\n"},
+		{"BackgroundFunction", []string{"-c", "f() { echo one; echo two; }; f &"}, 0, "one\ntwo\n"},
+		{"BackgroundWait", []string{"-c", "echo hi & wait"}, 0, "hi\n"},
+		{"File", []string{script, "x", "y z"}, 0, script + " 2\n[x]\n[y z]\nbg\n"},
+		{"MissingFile", []string{filepath.Join(dir, "missing.sh")}, statusNotFound, ""},
+		{"NoShebang", []string{"-c", noShebang + " arg"}, 0, "plain arg\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, out := gosh(t, tt.args...)
+			if status != tt.status || out != tt.out {
+				t.Errorf("gosh %q = %d, %q; want %d, %q", tt.args, status, out, tt.status, tt.out)
+			}
+		})
+	}
+	// ядро запускает сценарий со строкой #! через gosh
+	if status, out := runGosh(t, exec.Command(shebang, "kernel")); status != 1 || out != "from kernel\n" {
+		t.Errorf("shebang script = %d, %q", status, out)
+	}
+}
+
+func TestEnvironmentBuiltins(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"sub/.keep": "",
+		"file.txt":  "",
+		"lib.sh":    "x=from-lib\ngreet() { echo hi $1; }\n",
+		"args.sh":   "echo $# $1\nreturn 4\necho not reached\n",
+		"bin/tool":  "#!/bin/sh\n",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", filepath.Join(dir, "bin")+":"+os.Getenv("PATH"))
+	t.Setenv("HOME", dir)
+	tests := []struct {
+		name   string
+		script string
+		status int
+		out    string
+	}{
+		{"CdHome", "cd sub; cd; pwd", 0, "{dir}\n"},
+		{"CdDash", "cd sub; cd -; pwd; echo $OLDPWD", 0, "{dir}\n{dir}\n{dir}/sub\n"},
+		{"CdDashTwice", "cd sub; cd -; cd -", 0, "{dir}\n{dir}/sub\n"},
+		{"CdExportsPwd", "cd sub; sh -c 'echo $PWD $OLDPWD'", 0, "{dir}/sub {dir}\n"},
+		{"CdNoOldpwd", "unset OLDPWD; cd - || echo failed", 0, "failed\n"},
+		{"CdRelative", "cd sub/../sub; pwd", 0, "{dir}/sub\n"},
+		{"CdNotDir", "cd file.txt", 1, ""},
+		{"CdMissing", "cd nowhere; pwd", 0, "{dir}\n"},
+		{"Alias", "alias ll='echo long'; ll x", 0, "long x\n"},
+		{"AliasList", "alias b=two a=one; alias; alias a", 0, "alias a=one\nalias b=two\nalias a=one\n"},
+		{"AliasMissing", "alias nope", 1, ""},
+		{"Unalias", "alias ll='echo long'; unalias ll; ll", statusNotFound, ""},
+		{"UnaliasAll", "alias a=x b=y; unalias -a; alias", 0, ""},
+		{"UnaliasMissing", "unalias nope", 1, ""},
+		{"UnsetVar", "x=1; unset x; echo [$x]", 0, "[]\n"},
+		{"UnsetExported", "export x=1; unset x; sh -c 'echo [$x]'", 0, "[]\n"},
+		{"UnsetFunction", "f() { echo f; }; unset f; f", statusNotFound, ""},
+		{"UnsetVarKeepsFunction", "f() { true; }; f=1; unset -v f; type f; echo [$f]", 0, "f is a function\n[]\n"},
+		{"UnsetFunctionKeepsVar", "f() { true; }; f=1; unset -f f; echo $f; type f", 1, "1\n"},
+		{"Type", "alias ll=ls; f() { true; }; type ll if f echo tool", 0,
+			"ll is aliased to `ls'\nif is a shell keyword\nf is a function\necho is a shell builtin\ntool is {dir}/bin/tool\n"},
+		{"TypeMissing", "type echo nope", 1, "echo is a shell builtin\n"},
+		{"Which", "which tool echo", 0, "{dir}/bin/tool\necho: shell built-in command\n"},
+		{"Source", "source lib.sh; echo $x; greet you", 0, "from-lib\nhi you\n"},
+		{"SourceRelative", "cd sub; source ../lib.sh; echo $x", 0, "from-lib\n"},
+		{"SourceArgs", "set -- a b; source args.sh x; echo $1", 0, "1 x\na\n"},
+		{"SourceReturn", "source args.sh", 4, "0\n"},
+		{"SourceMissing", "source nope.sh", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := newShell(false)
+			sh.dir = dir
+			status, out, _ := runShell(t, sh, tt.script)
+			want := strings.ReplaceAll(tt.out, "{dir}", dir)
+			if status != tt.status || out != want {
+				t.Errorf("runShell() = %d, %q; want %d, %q", status, out, tt.status, want)
+			}
+		})
+	}
+}
+
+func TestExpansion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "c.txt", ".hidden.go", "src/x.go", "src/deep/y.go", "src/deep/z.txt", "dir1/", "dir2/"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		script string
+		out    string
+	}{
+		{"BraceList", "echo a{b,c}d", "abd acd\n"},
+		{"BraceNested", "echo {a,b{1,2}}", "a b1 b2\n"},
+		{"BraceEmpty", "echo x{,y}", "x xy\n"},
+		{"BraceRange", "echo {1..5}", "1 2 3 4 5\n"},
+		{"BraceStep", "echo {1..10..3}", "1 4 7 10\n"},
+		{"BraceReverse", "echo {5..1..2}", "5 3 1\n"},
+		{"BraceNegative", "echo {-2..1}", "-2 -1 0 1\n"},
+		{"BraceLetters", "echo {a..e..2}", "a c e\n"},
+		{"BracePadded", "echo {08..11}", "08 09 10 11\n"},
+		{"BraceProduct", "echo {a,b}{1..2}", "a1 a2 b1 b2\n"},
+		{"BraceLiteral", "echo {a} {} {1..x} {1..2..0}", "{a} {} {1..x} {1..2..0}\n"},
+		{"BraceHuge", "echo {1..9999999999} {0..9223372036854775807..2}", "{1..9999999999} {0..9223372036854775807..2}\n"},
+		{"BraceMaxInt", "echo {9223372036854775805..9223372036854775807}", "9223372036854775805 9223372036854775806 9223372036854775807\n"},
+		{"BraceMinInt", "echo {-9223372036854775807..-9223372036854775808}", "-9223372036854775807 -9223372036854775808\n"},
+		{"BraceFullRange", "echo {-9223372036854775808..9223372036854775807..9223372036854775807}",
+			"-9223372036854775808 -1 9223372036854775806\n"},
+		{"BraceMinStep", "echo {1..3..-9223372036854775808}", "1\n"},
+		{"BraceQuoted", `echo '{a,b}' "{a,b}" \{a,b\} {'a,b'}`, "{a,b} {a,b} {a,b} {a,b}\n"},
+		{"BraceAfterVar", "x=1; echo ${x}{a,b}", "1a 1b\n"},
+		{"Star", "echo *.go", "a.go b.go\n"},
+		{"Question", "echo ?.txt", "c.txt\n"},
+		{"Class", "echo [ab].go", "a.go b.go\n"},
+		{"NegatedClass", "echo [!a].go", "b.go\n"},
+		{"Hidden", "echo .*.go", ".hidden.go\n"},
+		{"Dirs", "echo */", "dir1/ dir2/ src/\n"},
+		{"Nested", "echo src/*/*.txt", "src/deep/z.txt\n"},
+		{"DoubleStar", "echo **/*.go", "a.go b.go src/deep/y.go src/x.go\n"},
+		{"DoubleStarDir", "echo src/**", "src/deep src/deep/y.go src/deep/z.txt src/x.go\n"},
+		{"Absolute", "echo {dir}/*.txt", "{dir}/c.txt\n"},
+		{"NoMatch", "echo *.rs src/*/none", "*.rs src/*/none\n"},
+		{"QuotedGlob", `echo '*.go' "*.go" \*.go`, "*.go *.go *.go\n"},
+		{"QuotedVar", `p='*.go'; echo "$p"`, "*.go\n"},
+		{"BraceThenGlob", "echo {a,c}.*", "a.go c.txt\n"},
+		{"External", "printf '%s\\n' *.go x{1..2}", "a.go\nb.go\nx1\nx2\n"},
+		{"ExternalQuoted", "printf '%s\\n' '*.go' '{1..2}'", "*.go\n{1..2}\n"},
+		{"BuiltinCd", "cd sr*; pwd", "{dir}/src\n"},
+		{"ForLoop", "for f in src/*.go {x,y}; do echo $f; done", "src/x.go\nx\ny\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := strings.ReplaceAll(tt.script, "{dir}", dir)
+			sh := newShell(false)
+			sh.dir = dir
+			status, out, errOut := runShell(t, sh, script)
+			want := strings.ReplaceAll(tt.out, "{dir}", dir)
+			if status != 0 || out != want {
+				t.Errorf("runShell(%q) = %d, %q, stderr %q; want %q", script, status, out, errOut, want)
+			}
+		})
+	}
+}
+
+func TestHistoryExpand(t *testing.T) {
+	h := &cmdHistory{lines: []string{"echo one", "ls -l", "echo three"}}
+	tests := []struct {
+		line, want string
+		changed    bool
+		err        string
+	}{
+		{"!!", "echo three", true, ""},
+		{"sudo !!", "sudo echo three", true, ""},
+		{"!1", "echo one", true, ""},
+		{"!2 /tmp", "ls -l /tmp", true, ""},
+		{"!-2", "ls -l", true, ""},
+		{"!1; !!", "echo one; echo three", true, ""},
+		{"echo '!!'", "echo '!!'", false, ""},
+		{`echo \!!`, `echo \!!`, false, ""},
+		{"echo hi!", "echo hi!", false, ""},
+		{"echo !x", "echo !x", false, ""},
+		{"!4", "", false, "!4: event not found"},
+		{"!0", "", false, "!0: event not found"},
+		{"echo !-4", "", false, "!-4: event not found"},
+	}
+	for _, tt := range tests {
+		got, changed, err := h.expand(tt.line)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expand(%q): err = %v, want %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || changed != tt.changed {
+			t.Errorf("expand(%q) = %q, %v, %v; want %q, %v", tt.line, got, changed, err, tt.want, tt.changed)
+		}
+	}
+	if _, _, err := (&cmdHistory{}).expand("!!"); err == nil {
+		t.Errorf("!! with empty history: no error")
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".gosh_history")
+	h := loadHistory(file)
+	for _, line := range []string{"echo a", "", "  ", "echo b", "echo b", "echo a"} {
+		h.add(line)
+	}
+	want := []string{"echo a", "echo b", "echo a"}
+	if got := loadHistory(file).lines; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("reloaded history = %q, want %q", got, want)
+	}
+
+	// длинный файл при загрузке обрезается до последних historySize строк
+	var sb strings.Builder
+	for i := 1; i <= historySize+5; i++ {
+		fmt.Fprintf(&sb, "cmd %d\n", i)
+	}
+	if err := os.WriteFile(file, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h = loadHistory(file)
+	if len(h.lines) != historySize || h.lines[0] != "cmd 6" {
+		t.Errorf("loaded %d lines starting with %q", len(h.lines), h.lines[0])
+	}
+	h.add("new")
+	if len(h.lines) != historySize || h.lines[0] != "cmd 7" || h.lines[historySize-1] != "new" {
+		t.Errorf("after add: %d lines, first %q", len(h.lines), h.lines[0])
+	}
+	if got := loadHistory(file).lines; len(got) != historySize || got[len(got)-1] != "new" {
+		t.Errorf("reloaded %d lines, last %q", len(got), got[len(got)-1])
+	}
+	if err := h.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadHistory(file).lines; len(h.lines) != 0 || len(got) != 0 {
+		t.Errorf("after clear: %q, file %q", h.lines, got)
+	}
+	// без файла история только в памяти
+	h = loadHistory("")
+	h.add("x")
+	if len(h.lines) != 1 {
+		t.Errorf("in-memory history = %q", h.lines)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	tests := []struct {
+		word       string
+		candidates []string
+		repl       string
+		list       string
+	}{
+		{"ec", nil, "", ""},
+		{"ec", []string{"echo"}, "echo ", ""},
+		{"sr", []string{"src/"}, "src/", ""},
+		{"a", []string{"alpha.txt", "alpine/"}, "alp", ""},
+		{"alp", []string{"alpha.txt", "alpine/"}, "", "alpha.txt  alpine/"},
+		{"dir/a", []string{"dir/a1", "dir/a2"}, "", "a1  a2"},
+	}
+	for _, tt := range tests {
+		repl, list := completion(tt.word, tt.candidates)
+		if repl != tt.repl || strings.Join(list, "  ") != tt.list {
+			t.Errorf("completion(%q, %q) = %q, %q; want %q, %q", tt.word, tt.candidates, repl, list, tt.repl, tt.list)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	for name, mode := range map[string]os.FileMode{
+		"bin/gosh-test-tool": 0755,
+		"bin/gosh-test-data": 0644,
+		"alpha.txt":          0644,
+		"alpine/inner.go":    0644,
+		"dir with space/x":   0644,
+		".hidden":            0644,
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sh := newShell(false)
+	sh.dir = dir
+	sh.vars["PATH"] = bin
+	sh.funcs["gosh-test-func"] = &simpleCmd{}
+	sh.aliases["gosh-test-alias"] = "ls"
+
+	tests := []struct {
+		head, word string
+		want       []string
+	}{
+		{"ec", "ec", []string{"echo"}},
+		{"hist", "hist", []string{"history"}},
+		{"gosh-test-", "gosh-test-", []string{"gosh-test-alias", "gosh-test-func", "gosh-test-tool"}},
+		{"true && ex", "ex", []string{"exit", "export"}},
+		{"if ec", "ec", []string{"echo"}},
+		{"cat al", "al", []string{"alpha.txt", "alpine/"}},
+		{"cat alpine/", "alpine/", []string{"alpine/inner.go"}},
+		{"cat .h", ".h", []string{".hidden"}},
+		{"cat ", "", []string{"alpha.txt", "alpine/", "bin/", `dir\ with\ space/`}},
+		{`ls dir\ w`, `dir\ w`, []string{`dir\ with\ space/`}},
+		{"./al", "./al", []string{"./alpha.txt", "./alpine/"}},
+		{"cat " + bin + "/gosh-test-d", bin + "/gosh-test-d", []string{bin + "/gosh-test-data"}},
+		{"cat nothing", "nothing", nil},
+	}
+	for _, tt := range tests {
+		word, got := sh.complete(tt.head)
+		if word != tt.word || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("complete(%q) = %q, %q; want %q, %q", tt.head, word, got, tt.word, tt.want)
+		}
+	}
+}
+
+func TestKill(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		status int
+		out    string
+	}{
+		{"ListNumber", "kill -l 9 15", 0, "KILL\nTERM\n"},
+		{"ListExitStatus", "kill -l 137", 0, "KILL\n"},
+		{"ListName", "kill -l TERM sigusr1 SIGHUP", 0, "15\n10\n1\n"},
+		{"ListInvalid", "kill -l NOPE", 1, ""},
+		{"NoSuchJob", "kill %5", 1, ""},
+		{"InvalidTarget", "kill abc", 1, ""},
+		{"InvalidSignal", "kill -NOPE 1", 1, ""},
+		{"MissingTarget", "kill -9", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, out, _ := runShell(t, newShell(false), tt.script)
+			if status != tt.status || out != tt.out {
+				t.Errorf("runShell() = %d, %q; want %d, %q", status, out, tt.status, tt.out)
+			}
+		})
+	}
+
+	jobs := []struct {
+		name string
+		args string
+		sig  syscall.Signal
+	}{
+		{"JobDefault", "%1", syscall.SIGTERM},
+		{"JobName", "-KILL %1", syscall.SIGKILL},
+		{"JobSigName", "-SIGINT %%", syscall.SIGINT},
+		{"JobNumber", "-9 %1", syscall.SIGKILL},
+		{"JobOption", "-s usr1 %1", syscall.SIGUSR1},
+	}
+	for _, tt := range jobs {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := newShell(false)
+			if status, _, errOut := runShell(t, sh, "sleep 10 & kill "+tt.args); status != 0 || len(sh.jobs) != 1 {
+				t.Fatalf("kill %s: status %d, stderr %q", tt.args, status, errOut)
+			}
+			j := sh.jobs[0]
+			j.wait(0)
+			if ws := j.last.status; !ws.Signaled() || ws.Signal() != tt.sig {
+				t.Errorf("kill %s: job status %v", tt.args, ws)
+			}
+		})
+	}
+
+	_, out, _ := runShell(t, newShell(false), "kill -l")
+	first := " 1) SIGHUP     \t 2) SIGINT     \t 3) SIGQUIT    \t 4) SIGILL     \t 5) SIGTRAP    \n"
+	if !strings.HasPrefix(out, first) || !strings.Contains(out, "\t15) SIGTERM    \n") {
+		t.Errorf("kill -l:\n%s", out)
+	}
+
+	// несколько процессов по pid
+	var cmds []*exec.Cmd
+	var pids []string
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+		cmds = append(cmds, cmd)
+		pids = append(pids, strconv.Itoa(cmd.Process.Pid))
+	}
+	if status, _, errOut := runShell(t, newShell(false), "kill -USR1 "+strings.Join(pids, " ")); status != 0 {
+		t.Fatalf("kill pids: status %d, stderr %q", status, errOut)
+	}
+	for _, cmd := range cmds {
+		cmd.Wait()
+		if ws := cmd.ProcessState.Sys().(syscall.WaitStatus); !ws.Signaled() || ws.Signal() != syscall.SIGUSR1 {
+			t.Errorf("pid %d: %v", cmd.Process.Pid, cmd.ProcessState)
+		}
+	}
+}
+
+func TestWaitReaped(t *testing.T) {
+	sh := newShell(false)
+	if status, _, errOut := runShell(t, sh, "sleep 0.1 &"); status != 0 || len(sh.jobs) != 1 {
+		t.Fatalf("sleep &: status %d, stderr %q", status, errOut)
+	}
+	// процесс задания ожидается в обход оболочки, и wait4 в ней вернёт ECHILD
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(sh.jobs[0].procs[0].pid, &ws, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	status, out, errOut := runShell(t, sh, "wait %1 && echo ok")
+	if status != 127 || out != "" || !strings.Contains(errOut, "exit status unknown") {
+		t.Errorf("wait %%1 = %d, %q, %q; want 127 and an error", status, out, errOut)
+	}
+}
+
+func TestParsePSArgs(t *testing.T) {
+	tests := []struct {
+		args        []string
+		all, forest bool
+		columns     string
+		err         string
+	}{
+		{nil, false, false, "pid,tty,time,comm", ""},
+		{[]string{"-e"}, true, false, "pid,tty,time,comm", ""},
+		{[]string{"-ef"}, true, false, "user,pid,ppid,%cpu,start,tty,time,args", ""},
+		{[]string{"aux"}, true, false, "user,pid,%cpu,%mem,vsz,rss,tty,stat,start,time,args", ""},
+		{[]string{"-o", "pid,ppid,user,args"}, false, false, "pid,ppid,user,args", ""},
+		{[]string{"-opid,cmd", "-o", "STATE"}, false, false, "pid,args,stat", ""},
+		{[]string{"-e", "-o", "pid, pcpu ,pmem", "--forest"}, true, true, "pid,%cpu,%mem", ""},
+		{[]string{"-f", "-o", "comm"}, false, false, "comm", ""},
+		{[]string{"-AH"}, true, true, "pid,tty,time,comm", ""},
+		{[]string{"axf"}, true, true, "pid,tty,time,comm", ""},
+		{[]string{"-o"}, false, false, "", ErrMissingArgument.Error()},
+		{[]string{"-o", "pid,nope"}, false, false, "", "nope: unknown column"},
+		{[]string{"-o", "pid,"}, false, false, "", ": unknown column"},
+		{[]string{"-z"}, false, false, "", "-z: unknown option"},
+		{[]string{"q"}, false, false, "", "q: unknown option"},
+	}
+	for _, tt := range tests {
+		opts, err := parsePSArgs(tt.args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parsePSArgs(%q): err = %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || opts.all != tt.all || opts.forest != tt.forest || strings.Join(opts.columns, ",") != tt.columns {
+			t.Errorf("parsePSArgs(%q) = %+v, %v; want all %v, forest %v, columns %s",
+				tt.args, opts, err, tt.all, tt.forest, tt.columns)
+		}
+	}
+}
+
+func TestPS(t *testing.T) {
+	status, out, errOut := runShell(t, newShell(false), "ps -e -o pid,ppid,user,comm")
+	if status != 0 {
+		t.Fatalf("status %d, stderr %q", status, errOut)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if fields := strings.Fields(lines[0]); strings.Join(fields, " ") != "PID PPID USER COMMAND" {
+		t.Errorf("header = %q", lines[0])
+	}
+	self := strconv.Itoa(os.Getpid())
+	found := false
+	for _, line := range lines[1:] {
+		if f := strings.Fields(line); len(f) == 4 && f[0] == self {
+			found = f[1] == strconv.Itoa(os.Getppid()) && f[2] == userName(uint32(os.Geteuid()))
+		}
+	}
+	if !found {
+		t.Errorf("own process %s not listed correctly:\n%s", self, out)
+	}
+
+	// без опций - процессы того же терминала, а без терминала - той же сессии
+	sibling := exec.Command("sleep", "10")
+	detached := exec.Command("sleep", "10")
+	detached.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	for _, cmd := range []*exec.Cmd{sibling, detached} {
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+	}
+	_, out, _ = runShell(t, newShell(false), "ps -o pid")
+	pids := strings.Fields(out)
+	for _, want := range []struct {
+		pid    int
+		listed bool
+	}{{os.Getpid(), true}, {sibling.Process.Pid, true}, {detached.Process.Pid, false}} {
+		listed := false
+		for _, pid := range pids {
+			listed = listed || pid == strconv.Itoa(want.pid)
+		}
+		if listed != want.listed {
+			t.Errorf("ps: pid %d listed = %v, want %v:\n%s", want.pid, listed, want.listed, out)
+		}
+	}
+
+	if status, _, errOut := runShell(t, newShell(false), "ps -o nope"); status != 1 || !strings.Contains(errOut, "nope: unknown column") {
+		t.Errorf("unknown column: status %d, stderr %q", status, errOut)
+	}
+
+	// кэш имён пользователей используется из параллельно выполняемых ps
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(uid uint32) {
+			defer wg.Done()
+			userName(uid)
+		}(uint32(60000 + i%3))
+	}
+	wg.Wait()
+}
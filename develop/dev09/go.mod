@@ -1,3 +1,5 @@
 module wget-go
 
 go 1.18
+
+require github.com/andybalholm/brotli v1.1.1
@@ -1,40 +1,1404 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
-func TestLinkStripper(t *testing.T) {
-	r := strings.NewReader(`123<a href="http://link1.ru?qwe=12%20asd"></a>456<img src="/link2/image.jpg"></img>789<style src="/styles/link3.css">000`)
-	w := strings.Builder{}
-	links, err := copyWithRenewedLinks(r, &w, -1)
+func TestParseHTML(t *testing.T) {
+	doc := `<html><head><base href="http://example.com/docs/">
+<link rel=stylesheet href='css/site.css'><style>body { background: url("img/bg.png") } @import 'print.css';</style>
+<meta http-equiv="refresh" content="5; url=/next.html"></head>
+<body style="background-image: url( /img/body.png )">
+<!-- <a href="commented.html"> -->
+<a HREF=page.html?a=1&amp;b=2>x</a> <img src = "a.png" srcset="a-1x.png 1x, a-2x.png 2x,a-3x.png">
+<script>var s = "<a href='script.html'>";</script>
+<a href="#top">top</a></body></html>`
+	var got []string
+	for _, ref := range parseHTML([]byte(doc)) {
+		if doc[ref.start:ref.end] != ref.url && !strings.Contains(doc[ref.start:ref.end], "&amp;") {
+			t.Errorf("ref %q: position points to %q", ref.url, doc[ref.start:ref.end])
+		}
+		got = append(got, ref.url)
+	}
+	want := []string{
+		"http://example.com/docs/", "css/site.css", "img/bg.png", "print.css", "/next.html",
+		"/img/body.png", "page.html?a=1&b=2", "a.png", "a-1x.png", "a-2x.png", "a-3x.png", "#top",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("links:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestCrawlerCycles(t *testing.T) {
+	pages := map[string]string{
+		"/":             `<a href="/a.html">a</a> <a href='b/'>b</a> <img srcset="/img/x.png 1x, /img/y.png 2x">`,
+		"/a.html":       `<a href=/>home</a> <a href="b/#part">b</a> <link rel=stylesheet href=style.css>`,
+		"/b/":           `<base href="/b/sub/"><a href="c.html">c</a> <a href="/a.html">a</a>`,
+		"/b/sub/c.html": `<a href="../../">home</a><a href="/missing.html">broken</a>`,
+		"/style.css":    `body { background: url('/img/bg.png') }`,
+		"/img/x.png":    "x",
+		"/img/y.png":    "y",
+		"/img/bg.png":   "bg",
+		"/unreachable/": "never linked",
+	}
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch path.Ext(r.URL.Path) {
+		case ".css":
+			w.Header().Set("Content-Type", "text/css")
+		case ".png":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := downloadSite(dir, srv.URL+"/", defaultCrawlOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/a.html", "/b/", "/b/sub/c.html", "/style.css", "/img/x.png", "/img/y.png", "/img/bg.png", "/missing.html"} {
+		if hits[p] != 1 {
+			t.Errorf("%s fetched %d times, want 1", p, hits[p])
+		}
+	}
+	if hits["/unreachable/"] != 0 {
+		t.Errorf("/unreachable/ fetched")
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for _, name := range []string{"index.html", "a.html", "b/index.html", "b/sub/c.html", "style.css", "img/bg.png"} {
+		if _, err := os.Stat(filepath.Join(dir, host, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// с ограничением глубины скачиваются только страница и ссылки с неё
+	hits = make(map[string]int)
+	if err := downloadSite(t.TempDir(), srv.URL+"/", crawlOptions{depth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if hits["/a.html"] != 1 || hits["/img/x.png"] != 1 || hits["/style.css"] != 0 || hits["/b/sub/c.html"] != 0 {
+		t.Errorf("depth 2: hits = %v", hits)
+	}
+}
+
+func TestConvertLinks(t *testing.T) {
+	pages := map[string]string{
+		"/":             `<a href="/docs/">docs</a> <a href="/docs/guide#sec">guide</a> <a href="http://external.invalid/x">ext</a>`,
+		"/docs/":        `<a href="guide">guide</a> <a href="#top">top</a> <a href="../">home</a> <a href="/search?q=a&amp;n=1">s</a>`,
+		"/docs/guide":   `<link rel=stylesheet href="/css/site.css"><a href="/missing">m</a>`,
+		"/css/site.css": `body { background: url(../img/bg.png) }`,
+		"/img/bg.png":   "bg",
+		"/search":       "results",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch path.Ext(r.URL.Path) {
+		case ".css":
+			w.Header().Set("Content-Type", "text/css")
+		case ".png":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.Header().Set("Content-Type", "text/html")
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.convertLinks = true
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for name, want := range map[string]string{
+		"index.html":      `<a href="docs/index.html">docs</a> <a href="docs/guide.html#sec">guide</a> <a href="http://external.invalid/x">ext</a>`,
+		"docs/index.html": `<a href="guide.html">guide</a> <a href="#top">top</a> <a href="../index.html">home</a> <a href="../search%3Fq=a&amp;n=1.html">s</a>`,
+		"docs/guide.html": `<link rel=stylesheet href="../css/site.css"><a href="` + srv.URL + `/missing">m</a>`,
+		"css/site.css":    `body { background: url(../img/bg.png) }`,
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, host, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+		}
+	}
+}
+
+func TestCrawlerEncoding(t *testing.T) {
+	// страницы в однобайтовых кодировках, сжатые gzip, zlib и голым deflate
+	type page struct {
+		body, contentType, encoding string
+		table                       *[128]rune
+	}
+	pages := map[string]page{
+		"/":             {`<meta charset="windows-1251"><a href="/статья">статья</a> <link rel=stylesheet href="/стиль.css">`, "text/html", "gzip", &windows1251},
+		"/статья":       {`<a href="/">назад</a> <img src="картинка.png" alt="&laquo;картинка&raquo;">`, "text/html; charset=KOI8-R", "deflate", &koi8r},
+		"/стиль.css":    {`@charset "koi8-r"; body { background: url(фон.png) }`, "text/css", "raw deflate", &koi8r},
+		"/картинка.png": {"png", "image/png", "", nil},
+		"/фон.png":      {"bg", "image/png", "", nil},
+	}
+	encoded := make(map[string][]byte)
+	for p, pg := range pages {
+		encoded[p] = encodeCharset(pg.body, pg.table)
+	}
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pg, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", pg.contentType)
+		var zw io.WriteCloser
+		switch pg.encoding {
+		case "gzip":
+			zw = gzip.NewWriter(w)
+		case "deflate":
+			zw = zlib.NewWriter(w)
+		case "raw deflate":
+			zw, _ = flate.NewWriter(w, flate.DefaultCompression)
+		}
+		if zw == nil {
+			w.Write(encoded[r.URL.Path])
+			return
+		}
+		w.Header().Set("Content-Encoding", strings.Fields(pg.encoding)[len(strings.Fields(pg.encoding))-1])
+		zw.Write(encoded[r.URL.Path])
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.convertLinks = true
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != len(pages) {
+		t.Errorf("requested %q", requested)
+	}
+	// файлы сохранены в своей кодировке, ссылки заменены на месте исходных байтов
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for name, want := range map[string][]byte{
+		"index.html":   encodeCharset(`<meta charset="windows-1251"><a href="%D1%81%D1%82%D0%B0%D1%82%D1%8C%D1%8F.html">статья</a> <link rel=stylesheet href="%D1%81%D1%82%D0%B8%D0%BB%D1%8C.css">`, &windows1251),
+		"статья.html":  encodeCharset(`<a href="index.html">назад</a> <img src="%D0%BA%D0%B0%D1%80%D1%82%D0%B8%D0%BD%D0%BA%D0%B0.png" alt="&laquo;картинка&raquo;">`, &koi8r),
+		"стиль.css":    encodeCharset(`@charset "koi8-r"; body { background: url(%D1%84%D0%BE%D0%BD.png) }`, &koi8r),
+		"картинка.png": []byte("png"),
+	} {
+		checkFile(t, filepath.Join(dir, host, name), want)
+	}
+
+	if got := documentCharset("html", "text/html", []byte("\xef\xbb\xbf<meta charset=koi8-r>")); got != "utf-8" {
+		t.Errorf("BOM: charset %q", got)
+	}
+	if got := documentCharset("html", "text/html", []byte(`<meta http-equiv="Content-Type" content="text/html; charset=cp1251">`)); got != "windows-1251" {
+		t.Errorf("http-equiv: charset %q", got)
+	}
+	if got := documentCharset("html", "text/html; charset=iso-8859-5", nil); got != "" {
+		t.Errorf("unsupported: charset %q", got)
+	}
+}
+
+func TestCrawlerBrotli(t *testing.T) {
+	// сервер отдаёт страницы только в br, ссылки берутся из распакованного тела
+	pages := map[string]string{
+		"/":       `<a href="/a.html">a</a> <link rel=stylesheet href="/b.css">`,
+		"/a.html": `<a href="/">back</a>`,
+		"/b.css":  `body { background: url(c.png) }`,
+		"/c.png":  "png",
+	}
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			http.Error(w, "br only", http.StatusNotAcceptable)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Encoding", "br")
+		bw := brotli.NewWriter(w)
+		bw.Write([]byte(body))
+		bw.Close()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(requested)
+	if want := []string{"/", "/a.html", "/b.css", "/c.png"}; strings.Join(requested, " ") != strings.Join(want, " ") {
+		t.Errorf("requested %q, want %q", requested, want)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for name, want := range map[string]string{
+		"index.html": pages["/"],
+		"a.html":     pages["/a.html"],
+		"b.css":      pages["/b.css"],
+		"c.png":      "png",
+	} {
+		checkFile(t, filepath.Join(dir, host, name), []byte(want))
+	}
+}
+
+// encodeCharset переводит s из UTF-8 в однобайтовую кодировку table.
+func encodeCharset(s string, table *[128]rune) []byte {
+	if table == nil {
+		return []byte(s)
+	}
+	var out []byte
+	for _, r := range s {
+		if r < 0x80 {
+			out = append(out, byte(r))
+			continue
+		}
+		for i, tr := range table {
+			if tr == r {
+				out = append(out, byte(0x80+i))
+				break
+			}
+		}
+	}
+	return out
+}
+
+func TestScopeRules(t *testing.T) {
+	start, _ := url.Parse("http://example.com/docs/index.html")
+	rules := scopeRules{
+		noParent:    true,
+		spanHosts:   true,
+		domains:     []string{"example.org"},
+		excludeDirs: []string{"/docs/private", "/docs/*/tmp"},
+		rejectRegex: regexp.MustCompile(`[?&]session=`),
+	}
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"http://example.com/docs/page.html", true},
+		{"http://example.com/docs", true},
+		{"http://example.com/other/page.html", false},
+		{"http://example.com/docs/private/a.html", false},
+		{"http://example.com/docs/v1/tmp/a.html", false},
+		{"http://example.com/docs/v1/a.html?session=1", false},
+		{"http://cdn.example.org/x.png", true},
+		{"http://example.net/x.png", false},
+	} {
+		u, _ := url.Parse(tt.url)
+		if got := rules.check(start, u); (got == "") != tt.want {
+			t.Errorf("check(%s) = %q, want allowed %v", tt.url, got, tt.want)
+		}
+	}
+	u, _ := url.Parse("http://example.com/docs/page.html")
+	if reason := (&scopeRules{}).check(start, u); reason != "" {
+		t.Errorf("same host rejected: %s", reason)
+	}
+	u, _ = url.Parse("http://cdn.example.org/x.png")
+	if (&scopeRules{}).check(start, u) == "" {
+		t.Errorf("other host allowed without --span-hosts")
+	}
+
+	files := scopeRules{accept: []string{"jpg", "*.PNG", "img-?.gif"}, reject: []string{"thumb*"}}
+	for name, want := range map[string]bool{
+		"a.jpg": true, "a.JPG": true, "b.PNG": true, "b.png": false,
+		"img-1.gif": true, "img-10.gif": false, "thumb.jpg": false, "index.html": false,
+	} {
+		u, _ := url.Parse("http://example.com/" + name)
+		if got := files.acceptFile(u); got != want {
+			t.Errorf("acceptFile(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	for s, want := range map[string]int64{"500": 500, "10k": 10 << 10, "1.5M": 3 << 19, "1g": 1 << 30} {
+		if got, err := parseSize(s); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+}
+
+func TestCrawlerScope(t *testing.T) {
+	pages := map[string]string{
+		"/":               `<a href="/gallery/">gallery</a> <a href="/big.jpg">big</a> <a href="/notes.txt">notes</a>`,
+		"/gallery/":       `<img src="a.jpg"> <img src="b.jpg"> <a href="2.html">next</a>`,
+		"/gallery/2.html": `<img src="c.jpg">`,
+		"/big.jpg":        strings.Repeat("x", 5000),
+		"/notes.txt":      "notes",
+		"/gallery/a.jpg":  "a",
+		"/gallery/b.jpg":  "b",
+		"/gallery/c.jpg":  "c",
+	}
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if path.Ext(r.URL.Path) == ".jpg" {
+			w.Header().Set("Content-Type", "image/jpeg")
+		} else if path.Ext(r.URL.Path) != ".txt" {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	// -A jpg: страницы читаются ради ссылок, но не сохраняются; большие файлы пропускаются
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.scope = scopeRules{accept: []string{"jpg"}, maxFileSize: 1000}
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for name, want := range map[string]bool{
+		"index.html": true, "gallery/a.jpg": true, "gallery/c.jpg": true,
+		"gallery/index.html": false, "gallery/2.html": false, "big.jpg": false, "notes.txt": false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, host, name))
+		if (err == nil) != want {
+			t.Errorf("%s: exists %v, want %v", name, err == nil, want)
+		}
+	}
+	if hits["/notes.txt"] != 0 {
+		t.Errorf("rejected file fetched")
+	}
+
+	// квота: после её превышения новые файлы не скачиваются
+	hits = make(map[string]int)
+	opts = defaultCrawlOptions()
+	opts.robots = false
+	opts.workers = 1
+	opts.scope = scopeRules{quota: 100}
+	if err := downloadSite(t.TempDir(), srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if hits["/gallery/"] != 1 || hits["/gallery/a.jpg"] != 0 {
+		t.Errorf("quota: hits = %v", hits)
+	}
+}
+
+func TestCrawlerTimestamping(t *testing.T) {
+	type file struct {
+		body    string
+		modTime time.Time
+	}
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := map[string]*file{
+		"/":       {`<a href="a.html">a</a> <img src="b.png">`, old},
+		"/a.html": {`<img src="c.png">`, old},
+		"/b.png":  {"b", old},
+		"/c.png":  {"c", old},
+	}
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		f, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		name := r.URL.Path
+		if name == "/" {
+			name = "index.html"
+		}
+		// ServeContent проверяет If-None-Match по заголовку ETag ответа
+		rec := httptest.NewRecorder()
+		if r.URL.Path == "/a.html" {
+			rec.Header().Set("ETag", fmt.Sprintf(`"%x"`, f.modTime.Unix()))
+		}
+		http.ServeContent(rec, r, name, f.modTime, strings.NewReader(f.body))
+		if rec.Code == http.StatusOK {
+			sent[r.URL.Path]++
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.timestamping = true
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 4 {
+		t.Fatalf("first run sent %v", sent)
+	}
+
+	// второй обход: изменился только b.png
+	mu.Lock()
+	files["/b.png"] = &file{"B", old.Add(time.Hour)}
+	sent = make(map[string]int)
+	mu.Unlock()
+	c := newCrawler(dir, opts)
+	c.stamps = loadStamps(dir)
+	if err := c.run(srv.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+	saveStamps(dir, c.stamps)
+	if len(sent) != 1 || sent["/b.png"] != 1 {
+		t.Errorf("second run sent %v, want only /b.png", sent)
+	}
+	if c.stats != (crawlStats{updated: 1, unchanged: 3}) {
+		t.Errorf("stats = %+v", c.stats)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	checkFile(t, filepath.Join(dir, host, "b.png"), []byte("B"))
+	checkFile(t, filepath.Join(dir, host, "c.png"), []byte("c"))
+
+	// удалённый файл скачивается заново
+	os.Remove(filepath.Join(dir, host, "c.png"))
+	sent = make(map[string]int)
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent["/c.png"] != 1 {
+		t.Errorf("third run sent %v, want only /c.png", sent)
+	}
+}
+
+func TestSpider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<a href="a.html">a</a> <a href="missing.html">m</a> <a href="/loop1">loop</a>
+<a href="http://nonexistent.invalid/">dns</a> <img src="img.png">`)
+		case "/a.html":
+			io.WriteString(w, `<a href="/">home</a> <a href="/error">err</a> <a href="missing.html">m</a>`)
+		case "/img.png":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, "png")
+		case "/loop1":
+			http.Redirect(w, r, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, r, "/loop1", http.StatusFound)
+		case "/error":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.spider = true
+	opts.retry = retryPolicy{tries: 1}
+	opts.scope.spanHosts = true
+	opts.client = newHTTPClient(clientOptions{})
+	c := newCrawler(dir, opts)
+	c.run(srv.URL + "/")
+	var out strings.Builder
+	c.report(&out)
+	report := out.String()
+	for _, want := range []string{
+		"Found 4 broken links.",
+		srv.URL + "/missing.html\n    404 Not Found\n    referred by " + srv.URL + "/\n    referred by " + srv.URL + "/a.html\n",
+		srv.URL + "/error\n    500 Internal Server Error\n    referred by " + srv.URL + "/a.html\n",
+		srv.URL + "/loop1\n    redirect loop\n",
+		"http://nonexistent.invalid/\n    DNS lookup failed",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spider saved %d files", len(files))
+	}
+	if err := downloadSites(dir, []string{srv.URL + "/a.html"}, opts); err != errBrokenLinks {
+		t.Errorf("err = %v, want errBrokenLinks", err)
+	}
+}
+
+func TestInputList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	list := filepath.Join(dir, "urls.txt")
+	os.WriteFile(list, []byte("# files\n"+srv.URL+"/a.txt\n\n  "+srv.URL+"/b/c.txt  \n"), 0644)
+	uris, err := readURLList(list)
+	if err != nil || len(uris) != 2 {
+		t.Fatalf("readURLList = %q, %v", uris, err)
+	}
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.depth = 1
+	if err := downloadSites(dir, uris, opts); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	checkFile(t, filepath.Join(dir, host, "a.txt"), []byte("/a.txt"))
+	checkFile(t, filepath.Join(dir, host, "b/c.txt"), []byte("/b/c.txt"))
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := `# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public.html
+Disallow: /*.pdf$
+
+User-agent: OtherBot
+User-agent: testbot
+Disallow: /secret
+Crawl-delay: 0.5
+`
+	tests := []struct {
+		agent, path string
+		allowed     bool
+	}{
+		{"wget-go/1.0", "/index.html", true},
+		{"wget-go/1.0", "/private/x.html", false},
+		{"wget-go/1.0", "/private/public.html", true},
+		{"wget-go/1.0", "/docs/manual.pdf", false},
+		{"wget-go/1.0", "/docs/manual.pdf?x=1", true},
+		{"testbot/2.0", "/private/x.html", true},
+		{"testbot/2.0", "/secret/x.html", false},
+		{"TestBot", "/secret.html", false},
+	}
+	for _, tt := range tests {
+		rules := parseRobots([]byte(robots), tt.agent)
+		u, _ := url.Parse("http://example.com" + tt.path)
+		if got := rules.allowed(u); got != tt.allowed {
+			t.Errorf("%s %s: allowed = %v, want %v", tt.agent, tt.path, got, tt.allowed)
+		}
+	}
+	if d := parseRobots([]byte(robots), "testbot").delay; d != 500*time.Millisecond {
+		t.Errorf("crawl delay = %v", d)
+	}
+}
+
+func TestCrawlerPoliteness(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		inFlight, peak int
+		hits           = make(map[string]int)
+		starts         []time.Time
+		agents         = make(map[string]bool)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		hits[r.URL.Path]++
+		starts = append(starts, time.Now())
+		agents[r.UserAgent()] = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		switch {
+		case r.URL.Path == "/robots.txt":
+			io.WriteString(w, "User-agent: *\nDisallow: /private/\n")
+		case r.URL.Path == "/":
+			w.Header().Set("Content-Type", "text/html")
+			for i := 0; i < 10; i++ {
+				fmt.Fprintf(w, `<a href="/page%d.html">%d</a>`, i, i)
+			}
+			io.WriteString(w, `<a href="/private/secret.html">secret</a>`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="/">home</a>`)
+		}
+	}))
+	defer srv.Close()
+
+	opts := defaultCrawlOptions()
+	opts.workers = 8
+	opts.hostConns = 3
+	opts.userAgent = "testbot/2.0"
+	if err := downloadSite(t.TempDir(), srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if peak > opts.hostConns {
+		t.Errorf("peak concurrent requests = %d, want <= %d", peak, opts.hostConns)
+	}
+	if peak < 2 {
+		t.Errorf("peak concurrent requests = %d, downloads are not concurrent", peak)
+	}
+	if hits["/private/secret.html"] != 0 || hits["/robots.txt"] != 1 || hits["/page9.html"] != 1 {
+		t.Errorf("hits = %v", hits)
+	}
+	if len(agents) != 1 || !agents["testbot/2.0"] {
+		t.Errorf("user agents = %v", agents)
+	}
+
+	// с --wait запросы к хосту идут не чаще одного за интервал
+	starts = nil
+	opts.wait = 20 * time.Millisecond
+	opts.robots = false
+	if err := downloadSite(t.TempDir(), srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	// моменты отправки запросов дрожат, поэтому проверяем время от первого запроса
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[0]); d < time.Duration(i)*opts.wait-5*time.Millisecond {
+			t.Errorf("request %d started %v after the first one", i, d)
+		}
+	}
+}
+
+func TestCrawlerHostBodies(t *testing.T) {
+	// заголовки уходят сразу, а тело передаётся медленно: слот хоста должен быть
+	// занят всю передачу, а не только до получения заголовков
+	var mu sync.Mutex
+	var inFlight, peak int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			for i := 0; i < 12; i++ {
+				fmt.Fprintf(w, `<a href="/file%d.bin">%d</a>`, i, i)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "data")
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.workers = 8
+	opts.hostConns = 2
+	if err := downloadSite(t.TempDir(), srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if peak > opts.hostConns {
+		t.Errorf("peak concurrent bodies = %d, want <= %d", peak, opts.hostConns)
+	}
+}
+
+// rangeServer отдаёт content с поддержкой Range и If-Range (через http.ServeContent).
+// Первые fail запросов обрываются после половины ответа.
+func rangeServer(t *testing.T, content []byte, etag *string, fail int) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range")+"|"+r.Header.Get("If-Range"))
+		n := len(ranges)
+		mu.Unlock()
+		w.Header().Set("ETag", *etag)
+		if n <= fail {
+			// объявляем полный размер, но отдаём только половину
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	etag := `"v1"`
+	opts := downloadOptions{retry: retryPolicy{tries: 3, wait: time.Millisecond}}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.bin")
+
+	// обрыв соединения: повтор продолжает с места обрыва
+	srv, ranges := rangeServer(t, content, &etag, 1)
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+	if want := fmt.Sprintf("bytes=%d-|%s", len(content)/2, etag); len(*ranges) != 2 || (*ranges)[1] != want {
+		t.Errorf("requests = %q, want second %q", *ranges, want)
+	}
+	if _, err := os.Stat(resumeStateName(name)); !os.IsNotExist(err) {
+		t.Errorf("resume state left after a complete download: %v", err)
+	}
+
+	// -c: докачка файла, оставшегося от прошлого запуска
+	srv, ranges = rangeServer(t, content, &etag, 0)
+	os.WriteFile(name, content[:1000], 0644)
+	saveResumeState(name, resumeState{URL: srv.URL, Validator: etag})
+	opts.resume = true
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+	if (*ranges)[0] != "bytes=1000-|"+etag {
+		t.Errorf("requests = %q", *ranges)
+	}
+
+	// файл на сервере изменился: If-Range не совпал, сервер отдаёт файл целиком
+	os.WriteFile(name, []byte("stale data"), 0644)
+	saveResumeState(name, resumeState{URL: srv.URL, Validator: `"v0"`})
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+
+	// файл уже скачан полностью
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+}
+
+func TestDownloadSegmented(t *testing.T) {
+	content := make([]byte, 4*minSegmentSize)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	var failed bool
+	noRanges := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if noRanges {
+			w.Write(content)
+			return
+		}
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			fail := !failed && strings.HasPrefix(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", 2*minSegmentSize))
+			failed = failed || fail
+			mu.Unlock()
+			if fail {
+				// третья часть обрывается на середине
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", 2*minSegmentSize, 3*minSegmentSize-1, len(content)))
+				w.Header().Set("Content-Length", strconv.Itoa(minSegmentSize))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[2*minSegmentSize : 2*minSegmentSize+1000])
+				return
+			}
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	opts := downloadOptions{retry: retryPolicy{tries: 3, wait: time.Millisecond}, segments: 4}
+	name := filepath.Join(t.TempDir(), "data.bin")
+
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+	want := fmt.Sprintf("bytes=%d-%d", 2*minSegmentSize+1000, 3*minSegmentSize-1)
+	if len(ranges) != 5 || !contains(ranges, want) {
+		t.Errorf("requests = %q, want 5 with %q", ranges, want)
+	}
+	if _, err := os.Stat(resumeStateName(name)); !os.IsNotExist(err) {
+		t.Errorf("resume state left after a complete download: %v", err)
+	}
+
+	// -c: докачиваются только незаконченные части
+	ranges = nil
+	segs := splitSegments(int64(len(content)), 4)
+	segs[0].Done = segs[0].size()
+	segs[1].Done = 10
+	segs[2].Done = segs[2].size()
+	segs[3].Done = segs[3].size()
+	partial := append([]byte(nil), content...)
+	for i := minSegmentSize + 10; i < 2*minSegmentSize; i++ {
+		partial[i] = 0
+	}
+	os.WriteFile(name, partial, 0644)
+	saveResumeState(name, resumeState{URL: srv.URL, Validator: `"v1"`, Size: int64(len(content)), Segments: segs})
+	opts.resume = true
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+	if want := fmt.Sprintf("bytes=%d-%d", minSegmentSize+10, 2*minSegmentSize-1); len(ranges) != 1 || ranges[0] != want {
+		t.Errorf("requests = %q, want %q", ranges, want)
+	}
+
+	// сервер без Range: скачивание одним потоком
+	noRanges = true
+	os.Remove(name)
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, content)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWARC(t *testing.T) {
+	pages := map[string]string{
+		"/":       `<a href="/a.html">a</a>`,
+		"/a.html": "page a",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "archive")
+	w, err := newWARCWriter(name, []string{"wget", "-m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.workers = 1
+	opts.client = newHTTPClient(clientOptions{warc: w})
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// все записи подряд: gzip.Reader читает последовательность потоков
+	f, err := os.Open(name + ".warc.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	t.Log("links:")
-	for _, l := range links {
-		t.Log(l)
+	var types []string
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if strings.HasPrefix(line, "WARC-Type: ") {
+			types = append(types, strings.TrimPrefix(line, "WARC-Type: "))
+		}
+	}
+	if want := "warcinfo request response request response"; strings.Join(types, " ") != want {
+		t.Errorf("records = %v, want %s", types, want)
+	}
+
+	// индекс указывает на отдельные gzip-потоки с ответами
+	cdx, err := os.ReadFile(name + ".cdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(cdx), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != " CDX N b a m s k r M S V g" {
+		t.Fatalf("cdx:\n%s", cdx)
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 11 || fields[4] != "200" || fields[10] != "archive.warc.gz" {
+			t.Errorf("cdx line %q", line)
+			continue
+		}
+		u, _ := url.Parse(fields[2])
+		if fields[0] != surt(u) {
+			t.Errorf("key %s for %s", fields[0], u)
+		}
+		offset, _ := strconv.ParseInt(fields[9], 10, 64)
+		length, _ := strconv.ParseInt(fields[8], 10, 64)
+		zr, err := gzip.NewReader(io.NewSectionReader(f, offset, length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr.Multistream(false)
+		record, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := pages[u.Path]
+		if !bytes.HasPrefix(record, []byte("WARC/1.1\r\nWARC-Type: response\r\n")) ||
+			!bytes.HasSuffix(record, []byte(body+"\r\n\r\n")) {
+			t.Errorf("record at %d:\n%s", offset, record)
+		}
+		if want := warcDigest(sha1Sum([]byte(body))); "sha1:"+fields[5] != want {
+			t.Errorf("%s: digest %s, want %s", u, fields[5], want)
+		}
+	}
+
+	for uri, want := range map[string]string{
+		"http://www.Example.com/Docs/a.html?q=1": "com,example)/docs/a.html?q=1",
+		"http://example.com:8080":                "com,example:8080)/",
+		"http://127.0.0.1/x":                     "127.0.0.1)/x",
+	} {
+		u, _ := url.Parse(uri)
+		if got := surt(u); got != want {
+			t.Errorf("surt(%s) = %s, want %s", uri, got, want)
+		}
 	}
-	t.Logf("out: %s", w.String())
 }
 
-func TestLinkToFileName(t *testing.T) {
-	links := []string{
-		"http://yandex.ru/qwe/iop/pic.jpg",
-		"/this/that/css/style.css",
-		"https://w3.org/qwerty?q=5&v=asd%20zxc"}
-	for _, link := range links {
-		t.Run(link, func(t *testing.T) {
-			filePath, err := linkToFilePath(link)
-			if err != nil {
-				t.Error(err)
+func TestClientAuth(t *testing.T) {
+	const realm, nonce = "test", "n0nce"
+	md5hex := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/basic":
+			if user, pass, ok := r.BasicAuth(); ok && user == "alice" && pass == "pw" {
+				io.WriteString(w, "basic ok")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		case "/digest":
+			p := parseAuthParams(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest "))
+			ha1 := md5hex("alice:" + realm + ":pw")
+			ha2 := md5hex(r.Method + ":" + p["uri"])
+			want := md5hex(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+			if p["response"] == want && p["opaque"] == "op" && p["uri"] == r.URL.RequestURI() {
+				io.WriteString(w, "digest ok")
+				return
 			}
-			dir, fileName := path.Split(filePath)
-			t.Logf("link: %s, dir: %s, fileName: %s", link, dir, fileName)
+			w.Header().Set("WWW-Authenticate", `Digest realm="test", nonce="`+nonce+`", qop="auth,auth-int", opaque="op"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
 
-		})
+	dir := t.TempDir()
+	opts := downloadOptions{retry: retryPolicy{tries: 1}}
+	for _, tt := range []struct {
+		path, password, want string
+	}{
+		{"/basic", "pw", "basic ok"},
+		{"/digest?x=1", "pw", "digest ok"},
+		{"/digest", "wrong", ""},
+	} {
+		copts := clientOptions{header: http.Header{"X-Token": {"secret"}}, user: "alice", password: tt.password}
+		opts.client = newHTTPClient(copts)
+		name := filepath.Join(dir, "out")
+		_, err := downloadFile(name, srv.URL+tt.path, opts)
+		if tt.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("%s with a wrong password: err = %v", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		checkFile(t, name, []byte(tt.want))
 	}
+}
+
+func TestCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method != http.MethodPost || r.FormValue("user") != "alice" {
+				http.Error(w, "bad login", http.StatusBadRequest)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+			http.SetCookie(w, &http.Cookie{Name: "pref", Value: "dark", Path: "/", MaxAge: 3600, HttpOnly: true})
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="/private/page.html">page</a>`)
+		case "/private/page.html":
+			if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+				http.Error(w, "login required", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "private")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
 
+	dir := t.TempDir()
+	jar := newCookieJar()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.postData = "user=alice"
+	opts.client = newHTTPClient(clientOptions{jar: jar})
+	if err := downloadSite(dir, srv.URL+"/login", opts); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	checkFile(t, filepath.Join(dir, host, "private/page.html"), []byte("private"))
+
+	// без --keep-session-cookies сохраняются только постоянные cookie
+	name := filepath.Join(dir, "cookies.txt")
+	if err := jar.save(name, false); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(name)
+	hostname := strings.Split(host, ":")[0]
+	if !strings.Contains(string(data), "#HttpOnly_"+hostname+"\tFALSE\t/\tFALSE\t") ||
+		!strings.Contains(string(data), "\tpref\tdark\n") || strings.Contains(string(data), "session") {
+		t.Errorf("saved cookies:\n%s", data)
+	}
+	if err := jar.save(name, true); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newCookieJar()
+	if err := loaded.load(name); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL + "/private/")
+	if got := len(loaded.Cookies(u)); got != 2 {
+		t.Errorf("loaded %d cookies, want 2", got)
+	}
+
+	// домен с точкой - cookie для всех поддоменов
+	os.WriteFile(name, []byte("# Netscape HTTP Cookie File\n.example.com\tTRUE\t/\tFALSE\t0\tid\t42\n"+
+		"example.com\tFALSE\t/\tFALSE\t1\texpired\tx\n"), 0600)
+	loaded = newCookieJar()
+	if err := loaded.load(name); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse("http://www.example.com/a")
+	if c := loaded.Cookies(u); len(c) != 1 || c[0].Name != "id" {
+		t.Errorf("cookies for %s = %v", u, c)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var target string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.URL.String()
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	opts := downloadOptions{retry: retryPolicy{tries: 1}, client: newHTTPClient(clientOptions{proxy: proxyURL})}
+	name := filepath.Join(t.TempDir(), "f")
+	if _, err := downloadFile(name, "http://example.invalid/file.txt", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, []byte("via proxy"))
+	if target != "http://example.invalid/file.txt" {
+		t.Errorf("proxy got request for %q", target)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	pages := map[string]string{
+		"/":        `<a href="a.html">a</a> <a href="missing.html">missing</a> <img src="img.png">`,
+		"/a.html":  `<a href="/">home</a>`,
+		"/img.png": "png",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if path.Ext(r.URL.Path) == ".png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := defaultCrawlOptions()
+	opts.robots = false
+	opts.convertLinks = true
+	opts.manifest = &manifest{}
+	if err := downloadSite(dir, srv.URL+"/", opts); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for _, name := range []string{"manifest.json", "manifest.csv"} {
+		name = filepath.Join(t.TempDir(), name)
+		if err := opts.manifest.write(name); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readManifest(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 {
+			t.Fatalf("%s: %d entries, want 4", name, len(entries))
+		}
+		// записи упорядочены по URL
+		img, missing := entries[2], entries[3]
+		if img.Path != host+"/img.png" || img.Status != 200 || img.Size != 3 || img.ContentType != "image/png" ||
+			img.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("png"))) {
+			t.Errorf("%s: img entry %+v", name, img)
+		}
+		if missing.Path != "" || missing.Status != 404 || missing.Error == "" {
+			t.Errorf("%s: missing entry %+v", name, missing)
+		}
+
+		var out strings.Builder
+		if bad, err := verifyManifest(name, dir, &out); err != nil || bad != 0 {
+			t.Errorf("verify after download: %d, %v\n%s", bad, err, out.String())
+		}
+	}
+
+	// страница после --convert-links совпадает с манифестом, а изменённые и удалённые файлы - нет
+	name := filepath.Join(t.TempDir(), "manifest.json")
+	opts.manifest.write(name)
+	os.WriteFile(filepath.Join(dir, host, "a.html"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(dir, host, "img.png"))
+	var out strings.Builder
+	if bad, err := verifyManifest(name, dir, &out); err != nil || bad != 2 ||
+		!strings.Contains(out.String(), "MISSING") || !strings.Contains(out.String(), "SIZE") {
+		t.Errorf("verify after changes: %d, %v\n%s", bad, err, out.String())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+	name := filepath.Join(t.TempDir(), "f")
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("data")))
+	m := &manifest{}
+	opts := downloadOptions{retry: retryPolicy{tries: 1}, checksum: "sha256:" + strings.ToUpper(sum), manifest: m}
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.checksum = "sha256:" + strings.Repeat("0", 64)
+	if _, err := downloadFile(name, srv.URL, opts); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("wrong checksum: err = %v", err)
+	}
+	opts.checksum = "md5:abc"
+	if _, err := downloadFile(name, srv.URL, opts); err == nil {
+		t.Errorf("unsupported checksum accepted")
+	}
+	if len(m.entries) != 3 || m.entries[0].SHA256 != sum || m.entries[0].Path != name || m.entries[1].Error == "" {
+		t.Errorf("manifest = %+v", m.entries)
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case calls < 3:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+	opts := downloadOptions{retry: retryPolicy{tries: 3, wait: time.Millisecond}}
+	name := filepath.Join(t.TempDir(), "f")
+	if _, err := downloadFile(name, srv.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, []byte("ok"))
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+	// 404 не повторяется
+	calls = 0
+	if _, err := downloadFile(name, srv.URL+"/missing", opts); err == nil || calls != 1 {
+		t.Errorf("404: err = %v, calls = %d", err, calls)
+	}
+}
+
+func TestFileNaming(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../report 2024.pdf"`)
+		io.WriteString(w, "pdf")
+	})
+	mux.HandleFunc("/utf8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.txt`)
+		io.WriteString(w, "txt")
+	})
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/app-1.2.tar.gz?sig=x", http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("archive"))
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html></html>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	opts := downloadOptions{retry: retryPolicy{tries: 1}}
+	for _, tt := range []struct {
+		path     string
+		segments int
+		want     string
+	}{
+		{"/download?id=5", 1, "report 2024.pdf"},
+		{"/utf8", 1, "отчёт.txt"},
+		{"/latest", 1, "app-1.2.tar.gz"},
+		{"/latest", 2, "app-1.2.tar.gz.1"},
+		{"/page?id=5", 1, "page.html"},
+		{"/page?id=5", 1, "page.html.1"},
+		{"/page", 1, "page.html.2"},
+	} {
+		opts.segments = tt.segments
+		name, err := downloadFile("", srv.URL+tt.path, opts)
+		if err != nil || name != tt.want {
+			t.Errorf("%s: name = %q, %v; want %q", tt.path, name, err, tt.want)
+		}
+	}
+	checkFile(t, "app-1.2.tar.gz", []byte("archive"))
+	checkFile(t, "page.html.1", []byte("<html></html>"))
+
+	// с явным именем файл перезаписывается
+	if _, err := downloadFile("page.html", srv.URL+"/download", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, "page.html", []byte("pdf"))
+
+	for uri, want := range map[string]string{
+		"https://x/download?id=5": "download",
+		"https://x/a/b/":          "index.html",
+		"https://x/":              "index.html",
+		"https://x":               "index.html",
+		"https://x/..":            "index.html",
+		"https://x/a%3Fb%2A.txt":  "a_b_.txt",
+	} {
+		if got := fileNameFromURI(uri); got != want {
+			t.Errorf("fileNameFromURI(%q) = %q, want %q", uri, got, want)
+		}
+	}
+	if got := sanitizeFileName("a\x00b\\c:d|e\n"); got != "c_d_e" {
+		t.Errorf("sanitizeFileName = %q", got)
+	}
+	if got := sanitizeFileName(strings.Repeat("я", 200) + ".txt"); len(got) > 255 || !strings.HasSuffix(got, "я.txt") {
+		t.Errorf("long name: %d bytes, %q", len(got), got[len(got)-10:])
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	got := formatProgress("file.iso", 512<<10, 1<<20, 256<<10)
+	want := "file.iso              50% [===============>              ]     512.0K     256.0K/s  eta 2s"
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if got := formatProgress("stream", 1500, -1, 0); got != "stream                     1.5K         0B/s" {
+		t.Errorf("unknown size: %q", got)
+	}
+}
+
+func checkFile(t *testing.T, name string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got %d bytes, want %d", name, len(got), len(want))
+	}
 }
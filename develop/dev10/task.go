@@ -16,7 +16,6 @@ go-telnet --timeout=10s host port go-telnet mysite.ru 8080 go-telnet --timeout=3
 */
 
 import (
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
@@ -28,6 +27,9 @@ import (
 	"time"
 )
 
+// closeTimeout - сколько после Ctrl+D ждать, пока сервер допишет ответ и закроет соединение.
+const closeTimeout = time.Second
+
 func main() {
 	timeoutFlag := flag.Uint("timeout", 10, "conn timeout")
 	flag.Parse()
@@ -49,29 +51,53 @@ func main() {
 	defer conn.Close()
 	log.Printf("Succesfully connected via %s to %s. Local %s addres is: %s",
 		conn.LocalAddr().Network(), conn.RemoteAddr(), conn.LocalAddr().Network(), conn.LocalAddr())
-	for {
-		fmt.Print(">> ")
-		reader := bufio.NewReader(os.Stdin)
-		text, err := reader.ReadString('\n')
+	if err := session(conn, os.Stdin, os.Stdout); err != nil {
+		conn.Close()
+		log.Fatal(err)
+	}
+}
+
+// session одновременно копирует in в соединение и данные из соединения в out.
+// Когда сервер закрывает соединение, session сразу возвращается, не дожидаясь ввода.
+// Когда ввод заканчивается (Ctrl+D), сервер получает EOF через CloseWrite, а его
+// оставшийся ответ дочитывается не дольше closeTimeout.
+func session(conn net.Conn, in io.Reader, out io.Writer) error {
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		received <- err
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, in)
+		sent <- err
+	}()
+
+	select {
+	case err := <-received:
 		if err != nil {
-			//закрываем соединение, если было нажато Ctrl+D
-			if err == io.EOF {
-				log.Println("\r                      \rClosing connection")
-				break
-			}
-			log.Fatal(err)
+			return err
+		}
+		log.Println("Connection closed by server")
+		return nil
+	case err := <-sent:
+		if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+			log.Println("Connection closed by server")
+			return nil
 		}
-		// отправляем в соединение
-		_, err = fmt.Fprint(conn, text)
 		if err != nil {
-			// если соединение закрыто
-			if errors.Is(err, syscall.EPIPE) {
-				log.Println("Connection closed by server")
-				break
-			}
-			log.Fatal(err)
+			return err
 		}
-		message, _ := bufio.NewReader(conn).ReadString('\n')
-		fmt.Print("->: " + message)
 	}
+	// ввод закончился - закрываем соединение на запись и дочитываем ответ
+	log.Println("Closing connection")
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	if err := <-received; err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return nil
 }
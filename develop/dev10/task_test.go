@@ -1 +1,76 @@
 package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve принимает одно соединение и обрабатывает его handle.
+func serve(t *testing.T, handle func(conn *net.TCPConn)) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn.(*net.TCPConn))
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSessionHalfClose(t *testing.T) {
+	// сервер сам здоровается, повторяет строки, а после EOF от клиента прощается
+	conn := serve(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "hello\n")
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			io.WriteString(conn, "> "+sc.Text()+"\n")
+		}
+		io.WriteString(conn, "bye\n")
+	})
+	var out strings.Builder
+	if err := session(conn, strings.NewReader("one\ntwo\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello\n> one\n> two\nbye\n"; out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
+
+func TestSessionServerClose(t *testing.T) {
+	conn := serve(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "first\nsecond\n")
+	})
+	// ввод не заканчивается, но session должна завершиться вместе с сервером
+	in, w := io.Pipe()
+	defer w.Close()
+	var out strings.Builder
+	done := make(chan error, 1)
+	go func() { done <- session(conn, in, &out) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not return after the server closed the connection")
+	}
+	if out.String() != "first\nsecond\n" {
+		t.Errorf("output %q", out.String())
+	}
+}